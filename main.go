@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
+	"time"
 
 	"./proxy"
+	"./upgrade"
 
 	"github.com/goji/httpauth"
 	"github.com/gorilla/mux"
@@ -17,6 +24,9 @@ import (
 
 var cfg proxy.Config
 
+// New process must start serving within this time or upgrade is cancelled
+const upgradeTimeout = time.Minute
+
 func startProxy() {
 	if cfg.Threads > 0 {
 		runtime.GOMAXPROCS(cfg.Threads)
@@ -28,31 +38,117 @@ func startProxy() {
 	}
 
 	r := mux.NewRouter()
-	s := proxy.NewEndpoint(&cfg)
+	// State of parent process is merged once we serve
+	cfg.Inherited = upgrade.IsChild()
+	chains := proxy.NewChainSet(&cfg)
 
-	go startFrontend(&cfg, s)
+	for _, s := range chains.Servers() {
+		r.Handle(s.Prefix()+"/miner/{diff:.+}/{id:.+}", s)
+	}
+	if sw := chains.Switcher(); sw != nil {
+		r.Handle(sw.Path()+"/miner/{diff:.+}/{id:.+}", sw)
+	}
+	server := &http.Server{Addr: cfg.Proxy.Listen, Handler: r}
+	frontend := newFrontend(&cfg, chains)
 
-	r.Handle("/miner/{diff:.+}/{id:.+}", s)
-	err := http.ListenAndServe(cfg.Proxy.Listen, r)
-	if err != nil {
+	// Listeners order is significant, child process inherits them by index
+	servers := []*http.Server{server, frontend}
+	listeners := make([]net.Listener, len(servers))
+	for i, srv := range servers {
+		l, err := upgrade.Listen(i, srv.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners[i] = l
+	}
+	for i, srv := range servers {
+		go serve(srv, listeners[i])
+	}
+	if upgrade.IsChild() {
+		if err := upgrade.Ready(len(listeners)); err != nil {
+			log.Printf("Unable to notify parent process: %v", err)
+		}
+		// Parent drains meanwhile, files of stateful services are merged even if state is lost
+		var snap proxy.Snapshot
+		if err := upgrade.ReadState(len(listeners), &snap); err != nil {
+			log.Printf("Unable to read state from parent process: %v", err)
+		}
+		chains.Restore(&snap)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, append(upgrade.Signals, syscall.SIGINT, syscall.SIGTERM)...)
+	for sig := range sigc {
+		if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+			log.Printf("Received %v, shutting down", sig)
+			shutdown(chains, servers...)
+			return
+		}
+		child, err := upgrade.Spawn(listeners...)
+		if err != nil {
+			log.Printf("Upgrade failed, keep serving: %v", err)
+			continue
+		}
+		log.Printf("Received %v, waiting for process %v to start serving", sig, child.Pid())
+		if err := child.WaitReady(upgradeTimeout); err != nil {
+			log.Printf("Upgrade failed, keep serving: %v", err)
+			child.Kill()
+			continue
+		}
+		log.Printf("Handing off to process %v", child.Pid())
+		shutdown(chains, servers...)
+		if err := child.WriteState(chains.Snapshot()); err != nil {
+			log.Printf("Unable to pass state to process %v: %v", child.Pid(), err)
+		}
+		return
+	}
+}
+
+func serve(server *http.Server, l net.Listener) {
+	err := server.Serve(l)
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
 
-func startFrontend(cfg *proxy.Config, s *proxy.ProxyServer) {
+// Stops accepting new connections, lets in-flight requests and upstream submissions finish
+func shutdown(chains *proxy.ChainSet, servers ...*http.Server) {
+	timeout, err := time.ParseDuration(cfg.Proxy.ShutdownTimeout)
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error while shutting down %v: %v", server.Addr, err)
+		}
+	}
+	if err := chains.Shutdown(ctx); err != nil {
+		log.Printf("Proxy shutdown incomplete: %v", err)
+	} else {
+		log.Println("Proxy shutdown complete")
+	}
+}
+
+// Stats of additional chains are selected by ?chain= param
+func newFrontend(cfg *proxy.Config, chains *proxy.ChainSet) *http.Server {
 	r := mux.NewRouter()
-	r.HandleFunc("/stats", s.StatsIndex)
+	r.HandleFunc("/stats", chains.Handle((*proxy.ProxyServer).StatsIndex))
+	r.HandleFunc("/stats/chains", chains.ChainsStats)
+	r.HandleFunc("/stats/switching", chains.SwitchingStats)
+	r.HandleFunc("/stats/miner/{id:.+}", chains.Handle((*proxy.ProxyServer).MinerStats))
+	r.HandleFunc("/stats/history", chains.Handle((*proxy.ProxyServer).HistoryStats))
+	r.HandleFunc("/stats/purge", chains.Handle((*proxy.ProxyServer).PurgeMiners))
+	r.HandleFunc("/stats/accounts", chains.Handle((*proxy.ProxyServer).AccountsStats))
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./www/")))
-	var err error
+	server := &http.Server{Addr: cfg.Frontend.Listen, Handler: r}
 	if len(cfg.Frontend.Password) > 0 {
 		auth := httpauth.SimpleBasicAuth(cfg.Frontend.Login, cfg.Frontend.Password)
-		err = http.ListenAndServe(cfg.Frontend.Listen, auth(r))
-	} else {
-		err = http.ListenAndServe(cfg.Frontend.Listen, r)
-	}
-	if err != nil {
-		log.Fatal(err)
+		server.Handler = auth(r)
 	}
+	return server
 }
 
 func startNewrelic() {
@@ -70,6 +166,10 @@ func readConfig(cfg *proxy.Config) {
 	if len(os.Args) > 1 {
 		configFileName = os.Args[1]
 	}
+	loadConfig(configFileName, cfg)
+}
+
+func loadConfig(configFileName string, cfg *proxy.Config) {
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
 
@@ -84,7 +184,110 @@ func readConfig(cfg *proxy.Config) {
 	}
 }
 
+func parseTimeFlag(name, value string) int64 {
+	if len(value) == 0 {
+		return 0
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("Invalid -%s value, RFC3339 expected: %v", name, err)
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Returns config of chain given by -chain flag
+func chainConfig(name string) *proxy.Config {
+	c, ok := cfg.ChainConfig(name)
+	if !ok {
+		log.Fatalf("Unknown chain: %s", name)
+	}
+	return c
+}
+
+// Usage: ether-proxy journal [-config config.json] [-chain name] [-path file] [-miner id] [-from time] [-to time]
+func queryJournal(args []string) {
+	flags := flag.NewFlagSet("journal", flag.ExitOnError)
+	configFileName := flags.String("config", "config.json", "Config file to take journal path from")
+	chain := flags.String("chain", "", "Chain to take journal path for, default chain if empty")
+	path := flags.String("path", "", "Journal file, overrides config")
+	miner := flags.String("miner", "", "Show only shares of this miner id")
+	from := flags.String("from", "", "Start of time range, RFC3339")
+	to := flags.String("to", "", "End of time range, RFC3339")
+	flags.Parse(args)
+
+	if len(*path) == 0 {
+		loadConfig(*configFileName, &cfg)
+		*path = chainConfig(*chain).Journal.Path
+	}
+	err := proxy.QueryJournal(*path, *miner, parseTimeFlag("from", *from), parseTimeFlag("to", *to), os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Usage: ether-proxy payouts [-config config.json] [-chain name] balances|batches|create|export|paid [-batch id] [-format csv|json] [-txs file] [-force]
+func managePayouts(args []string) {
+	flags := flag.NewFlagSet("payouts", flag.ExitOnError)
+	configFileName := flags.String("config", "config.json", "Config file with payouts section")
+	chain := flags.String("chain", "", "Chain to manage payouts for, default chain if empty")
+	batchId := flags.String("batch", "", "Batch id for export and paid commands")
+	format := flags.String("format", "csv", "Export format, csv or json")
+	txs := flags.String("txs", "", "CSV file of account,txHash lines or exported batch for paid command, stdin if empty")
+	force := flags.Bool("force", false, "Allow paid command to replace transaction hashes of paid payments")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		log.Fatal("Payouts command required: balances, batches, create, export or paid")
+	}
+	// Allow flags after command too
+	command := flags.Arg(0)
+	flags.Parse(flags.Args()[1:])
+
+	loadConfig(*configFileName, &cfg)
+	payouts := &chainConfig(*chain).Payouts
+	path := payouts.Path
+	var err error
+	switch command {
+	case "balances":
+		err = proxy.WriteBalances(path, os.Stdout)
+	case "batches":
+		err = proxy.WriteBatches(path, os.Stdout)
+	case "create":
+		var batch *proxy.PayoutBatch
+		if batch, err = proxy.CreateBatch(payouts); err == nil {
+			log.Printf("Created batch %s of %v payments", batch.Id, len(batch.Payments))
+			err = proxy.WriteBatch(batch, *format, os.Stdout)
+		}
+	case "export":
+		err = proxy.ExportBatch(path, *batchId, *format, os.Stdout)
+	case "paid":
+		r := os.Stdin
+		if len(*txs) > 0 {
+			if r, err = os.Open(*txs); err != nil {
+				break
+			}
+			defer r.Close()
+		}
+		var n int
+		if n, err = proxy.MarkPaid(path, *batchId, r, *force); err == nil {
+			log.Printf("Marked %v payments of batch %s as paid", n, *batchId)
+		}
+	default:
+		log.Fatalf("Unknown payouts command: %s", command)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "journal" {
+		queryJournal(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "payouts" {
+		managePayouts(os.Args[2:])
+		return
+	}
 	readConfig(&cfg)
 	startNewrelic()
 	startProxy()
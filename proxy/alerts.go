@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+const (
+	alertMinerWarning     = "minerWarning"
+	alertMinerTimeout     = "minerTimeout"
+	alertHashrateDrop     = "hashrateDrop"
+	alertLowHashrate      = "lowHashrate"
+	alertUpstreamSick     = "upstreamSick"
+	alertUpstreamSwitch   = "upstreamSwitch"
+	alertCoinbaseMismatch = "coinbaseMismatch"
+	alertBlockFound       = "blockFound"
+)
+
+type Alert struct {
+	Chain     string `json:"chain,omitempty"`
+	Kind      string `json:"kind"`
+	Subject   string `json:"subject"`
+	Message   string `json:"message"`
+	Recovered bool   `json:"recovered"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (a *Alert) Text() string {
+	tag := "[ether-proxy] "
+	if len(a.Chain) > 0 {
+		tag = "[ether-proxy/" + a.Chain + "] "
+	}
+	if a.Recovered {
+		return tag + "RECOVERED: " + a.Message
+	}
+	return tag + a.Message
+}
+
+type Notifier interface {
+	Notify(a *Alert) error
+}
+
+// Delivers alerts to notifiers. Conditions are reported once when raised
+// and once more when resolved, events are reported every time.
+type Alerter struct {
+	sync.Mutex
+	notifiers    []Notifier
+	active       map[string]bool
+	hashrateDrop float64
+	chain        string
+}
+
+func NewAlerter(cfg *Alerts, quit chan struct{}) *Alerter {
+	a := &Alerter{active: make(map[string]bool), hashrateDrop: cfg.HashrateDrop}
+	for i := range cfg.Webhooks {
+		a.notifiers = append(a.notifiers, NewWebhook(&cfg.Webhooks[i]))
+	}
+	if cfg.SMTP.Enabled {
+		a.notifiers = append(a.notifiers, NewMailer(&cfg.SMTP, quit))
+	}
+	return a
+}
+
+func (a *Alerter) send(alert *Alert) {
+	alert.Timestamp = util.MakeTimestamp()
+	alert.Chain = a.chain
+	log.Printf("Alert: %s", alert.Text())
+	for _, n := range a.notifiers {
+		go func(n Notifier) {
+			if err := n.Notify(alert); err != nil {
+				log.Printf("Unable to deliver %s alert: %v", alert.Kind, err)
+			}
+		}(n)
+	}
+}
+
+func (a *Alerter) event(kind, subject, msg string) {
+	if a == nil {
+		return
+	}
+	a.send(&Alert{Kind: kind, Subject: subject, Message: msg})
+}
+
+func (a *Alerter) raise(kind, subject, msg string) {
+	if a == nil {
+		return
+	}
+	key := kind + ":" + subject
+	a.Lock()
+	active := a.active[key]
+	a.active[key] = true
+	a.Unlock()
+	if !active {
+		a.send(&Alert{Kind: kind, Subject: subject, Message: msg})
+	}
+}
+
+func (a *Alerter) resolve(kind, subject, msg string) {
+	if a == nil {
+		return
+	}
+	key := kind + ":" + subject
+	a.Lock()
+	active := a.active[key]
+	delete(a.active, key)
+	a.Unlock()
+	if active {
+		a.send(&Alert{Kind: kind, Subject: subject, Message: msg, Recovered: true})
+	}
+}
+
+// Drops all raised conditions of removed miner or upstream
+func (a *Alerter) forget(subject string) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	for _, kind := range []string{alertMinerWarning, alertMinerTimeout, alertHashrateDrop, alertLowHashrate, alertUpstreamSick, alertCoinbaseMismatch} {
+		delete(a.active, kind+":"+subject)
+	}
+	a.Unlock()
+}
+
+func (s *ProxyServer) checkAlerts() {
+	now := util.MakeTimestamp()
+	for m := range s.miners.Iter() {
+		id := m.Key
+		warning, timeout := s.minerState(m.Val.getLastBeat(), now)
+		if timeout {
+			s.alerts.raise(alertMinerTimeout, id, fmt.Sprintf("Miner %s timed out", id))
+		} else if warning {
+			s.alerts.raise(alertMinerWarning, id, fmt.Sprintf("Miner %s didn't submit shares for %v", id, s.timeout/2))
+		} else {
+			s.alerts.resolve(alertMinerTimeout, id, fmt.Sprintf("Miner %s is back online", id))
+			s.alerts.resolve(alertMinerWarning, id, fmt.Sprintf("Miner %s is submitting shares again", id))
+		}
+
+		if timeout {
+			continue
+		}
+		if ratio, ok := m.Val.effectiveRatio(s.hashrateWindow, now); ok {
+			if s.isLowHashrate(ratio) {
+				s.alerts.raise(alertLowHashrate, id, fmt.Sprintf("Effective hashrate of miner %s is %.0f%% of reported", id, ratio*100))
+			} else {
+				s.alerts.resolve(alertLowHashrate, id, fmt.Sprintf("Effective hashrate of miner %s is %.0f%% of reported", id, ratio*100))
+			}
+		}
+		if s.alerts.hashrateDrop <= 0 {
+			continue
+		}
+		hashrate := m.Val.hashrate(s.hashrateWindow)
+		hashrate24h := m.Val.hashrate(24 * time.Hour)
+		if hashrate24h == 0 {
+			continue
+		}
+		drop := 100 * float64(hashrate24h-hashrate) / float64(hashrate24h)
+		if drop >= s.alerts.hashrateDrop {
+			s.alerts.raise(alertHashrateDrop, id, fmt.Sprintf("Hashrate of miner %s dropped by %.0f%% to %v H/s", id, drop, hashrate*1000))
+		} else {
+			s.alerts.resolve(alertHashrateDrop, id, fmt.Sprintf("Hashrate of miner %s is %v H/s", id, hashrate*1000))
+		}
+	}
+}
@@ -2,10 +2,15 @@ package proxy
 
 import (
 	"encoding/json"
+	"io"
+	"log"
+	"mime"
 	"net/http"
 	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/mux"
+
 	"../rpc"
 	"../util"
 )
@@ -14,7 +19,8 @@ func (s *ProxyServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
-	hashrate, hashrate24h, totalOnline, miners := s.collectMinersStats()
+	filter := parseGroupFilter(r.URL.Query()["group"])
+	hashrate, hashrate24h, totalOnline, miners, groups := s.collectMinersStats(filter)
 	stats := map[string]interface{}{
 		"miners":      miners,
 		"hashrate":    hashrate,
@@ -22,19 +28,30 @@ func (s *ProxyServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		"totalMiners": len(miners),
 		"totalOnline": totalOnline,
 		"timedOut":    len(miners) - totalOnline,
+		"groups":      groups,
+		"filter":      filter,
 	}
 
 	var upstreams []interface{}
 	current := atomic.LoadInt32(&s.upstream)
 
+	now := time.Now()
 	for i, u := range s.upstreams {
 		upstream := convertUpstream(u)
 		upstream["current"] = current == int32(i)
+		if sc := s.schedules[i]; sc != nil {
+			upstream["schedule"] = sc.specs
+			upstream["scheduled"] = sc.active(now)
+		}
 		upstreams = append(upstreams, upstream)
 	}
 	stats["upstreams"] = upstreams
 	stats["current"] = convertUpstream(s.rpc())
-	stats["url"] = "http://" + s.config.Proxy.Listen + "/miner/<diff>/<id>"
+	stats["url"] = s.minerUrl()
+	stats["chain"] = s.config.defaultChain()
+	if s.fee != nil {
+		stats["fee"] = s.fee.stats()
+	}
 
 	t := s.currentBlockTemplate()
 	stats["height"] = t.Height
@@ -44,6 +61,123 @@ func (s *ProxyServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
+func (s *ProxyServer) MinerStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	miner, ok := s.miners.Get(mux.Vars(r)["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Miner not found"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	now := util.MakeTimestamp()
+	stats := s.convertMiner(miner, now)
+	stats["history"] = miner.getHistory()
+	stats["historyBucket"] = historyBucket
+	stats["now"] = now
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (s *ProxyServer) HistoryStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	resolution := r.URL.Query().Get("resolution")
+	if len(resolution) == 0 {
+		resolution = "minute"
+	}
+	var history *SeriesResolution
+	ok := false
+	if s.series != nil {
+		history, ok = s.series.points(resolution)
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "History is not available"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	stats := map[string]interface{}{
+		"resolution": history.Name,
+		"step":       history.Step,
+		"retention":  history.Retention,
+		"points":     history.Points,
+		"now":        util.MakeTimestamp(),
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (s *ProxyServer) AccountsStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if s.subpool == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Sub-pool mode is disabled"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	stats := s.subpool.stats()
+	stats["now"] = util.MakeTimestamp()
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (s *ProxyServer) minerUrl() string {
+	if s.config.Proxy.AddressIds {
+		return "http://" + s.config.Proxy.Listen + s.config.Prefix + "/miner/<diff>/<address>.<worker>"
+	}
+	return "http://" + s.config.Proxy.Listen + s.config.Prefix + "/miner/<diff>/<id>"
+}
+
+// Removes miners given in JSON body, or all timed out miners if none given.
+// Purge requires frontend auth and JSON content type, so browsers can't send it cross-site.
+func (s *ProxyServer) PurgeMiners(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "POST method required"})
+		return
+	}
+	if len(s.config.Frontend.Password) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Purge requires frontend password"})
+		return
+	}
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "JSON body required"})
+		return
+	}
+	var req struct {
+		Ids []string `json:"ids"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Malformed JSON body"})
+		return
+	}
+
+	var purged int
+	if len(req.Ids) > 0 {
+		purged = s.purgeMiners(req.Ids, nil)
+	} else {
+		timedOut := func(m *Miner) bool {
+			_, timeout := s.minerState(m.getLastBeat(), util.MakeTimestamp())
+			return timeout
+		}
+		var ids []string
+		for m := range s.miners.Iter() {
+			if timedOut(m.Val) {
+				ids = append(ids, m.Key)
+			}
+		}
+		purged = s.purgeMiners(ids, timedOut)
+	}
+	log.Printf("Purged %v miners on request from %v", purged, r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"purged": purged})
+}
+
 func convertUpstream(u *rpc.RPCClient) map[string]interface{} {
 	upstream := map[string]interface{}{
 		"name":             u.Name,
@@ -54,46 +188,136 @@ func convertUpstream(u *rpc.RPCClient) map[string]interface{} {
 		"rejects":          atomic.LoadUint64(&u.Rejects),
 		"lastSubmissionAt": atomic.LoadInt64(&u.LastSubmissionAt),
 		"failsCount":       atomic.LoadUint64(&u.FailsCount),
+		"validShares":      atomic.LoadUint64(&u.ValidShares),
+		"invalidShares":    atomic.LoadUint64(&u.InvalidShares),
+		"staleShares":      atomic.LoadUint64(&u.StaleShares),
+		"malformedShares":  atomic.LoadUint64(&u.MalformedShares),
+		"duplicateShares":  atomic.LoadUint64(&u.DuplicateShares),
+		"hashrate":         atomic.LoadUint64(&u.Hashrate),
+		"hashrateAt":       atomic.LoadInt64(&u.HashrateAt),
+		"etherbase":        u.Etherbase,
+		"coinbase":         u.Coinbase(),
+		"coinbaseMismatch": u.CoinbaseMismatch(),
 	}
+	calls := u.Calls()
+	totalCalls := uint64(0)
+	for _, v := range calls {
+		totalCalls += v
+	}
+	upstream["calls"] = calls
+	upstream["totalCalls"] = totalCalls
+	upstream["coalescedCalls"], upstream["cachedCalls"] = u.SavedCalls()
 	return upstream
 }
 
-func (s *ProxyServer) collectMinersStats() (int64, int64, int, []interface{}) {
+type GroupStats struct {
+	Hashrate      int64  `json:"hashrate"`
+	Hashrate24h   int64  `json:"hashrate24h"`
+	TotalMiners   int    `json:"totalMiners"`
+	TotalOnline   int    `json:"totalOnline"`
+	ValidShares   uint64 `json:"validShares"`
+	InvalidShares uint64 `json:"invalidShares"`
+	StaleShares   uint64 `json:"staleShares"`
+}
+
+// Collects miners matching group filter and aggregates them per group level and name
+func (s *ProxyServer) collectMinersStats(filter map[string]string) (int64, int64, int, []interface{}, map[string]map[string]*GroupStats) {
 	now := util.MakeTimestamp()
 	var result []interface{}
 	totalHashrate := int64(0)
 	totalHashrate24h := int64(0)
 	totalOnline := 0
-	window24h := 24 * time.Hour
+	groups := make(map[string]map[string]*GroupStats)
 
 	for m := range s.miners.Iter() {
-		stats := make(map[string]interface{})
-		lastBeat := m.Val.getLastBeat()
-		hashrate := m.Val.hashrate(s.hashrateWindow)
-		hashrate24h := m.Val.hashrate(window24h)
+		minerGroups := s.groups.groupsOf(m.Key)
+		if !matchGroups(minerGroups, filter) {
+			continue
+		}
+		stats := s.convertMiner(m.Val, now)
+		stats["groups"] = minerGroups
+		hashrate := stats["hashrate"].(int64)
+		hashrate24h := stats["hashrate24h"].(int64)
+		_, timeout := stats["timeout"]
 		totalHashrate += hashrate
 		totalHashrate24h += hashrate24h
-		stats["name"] = m.Key
-		stats["hashrate"] = hashrate
-		stats["hashrate24h"] = hashrate24h
-		stats["lastBeat"] = lastBeat
-		stats["validShares"] = atomic.LoadUint64(&m.Val.validShares)
-		stats["invalidShares"] = atomic.LoadUint64(&m.Val.invalidShares)
-		stats["accepts"] = atomic.LoadUint64(&m.Val.accepts)
-		stats["rejects"] = atomic.LoadUint64(&m.Val.rejects)
-		stats["ip"] = m.Val.IP
-
-		if now-lastBeat > (int64(s.timeout/2) / 1000000) {
-			stats["warning"] = true
-		}
-		if now-lastBeat > (int64(s.timeout) / 1000000) {
-			stats["timeout"] = true
-		} else {
+		if !timeout {
 			totalOnline++
 		}
 		result = append(result, stats)
+
+		for level, name := range minerGroups {
+			if _, ok := groups[level]; !ok {
+				groups[level] = make(map[string]*GroupStats)
+			}
+			g, ok := groups[level][name]
+			if !ok {
+				g = &GroupStats{}
+				groups[level][name] = g
+			}
+			g.Hashrate += hashrate
+			g.Hashrate24h += hashrate24h
+			g.TotalMiners++
+			if !timeout {
+				g.TotalOnline++
+			}
+			g.ValidShares += stats["validShares"].(uint64)
+			g.InvalidShares += stats["invalidShares"].(uint64)
+			g.StaleShares += stats["staleShares"].(uint64)
+		}
+	}
+	return totalHashrate, totalHashrate24h, totalOnline, result, groups
+}
+
+func (s *ProxyServer) convertMiner(m *Miner, now int64) map[string]interface{} {
+	stats := make(map[string]interface{})
+	lastBeat := m.getLastBeat()
+	stats["name"] = m.Id
+	stats["hashrate"] = m.hashrate(s.hashrateWindow)
+	stats["hashrate24h"] = m.hashrate(24 * time.Hour)
+	stats["lastBeat"] = lastBeat
+	stats["validShares"] = atomic.LoadUint64(&m.validShares)
+	stats["invalidShares"] = atomic.LoadUint64(&m.invalidShares)
+	stats["staleShares"] = atomic.LoadUint64(&m.staleShares)
+	stats["malformedShares"] = atomic.LoadUint64(&m.malformedShares)
+	stats["duplicateShares"] = atomic.LoadUint64(&m.duplicateShares)
+	stats["accepts"] = atomic.LoadUint64(&m.accepts)
+	stats["rejects"] = atomic.LoadUint64(&m.rejects)
+	stats["ip"] = m.IP
+
+	info := m.getInfo()
+	stats["userAgent"] = info.UserAgent
+	stats["protocol"] = info.Protocol
+	stats["worker"] = info.Worker
+	stats["reportedHashrate"] = info.ReportedHashrate
+	stats["reportedAt"] = info.ReportedAt
+	if ratio, ok := m.effectiveRatio(s.hashrateWindow, now); ok {
+		stats["effectiveRatio"] = ratio
+		if s.isLowHashrate(ratio) {
+			stats["lowHashrate"] = true
+		}
+	}
+
+	warning, timeout := s.minerState(lastBeat, now)
+	if warning {
+		stats["warning"] = true
+	}
+	if timeout {
+		stats["timeout"] = true
 	}
-	return totalHashrate, totalHashrate24h, totalOnline, result
+	return stats
+}
+
+// Effective hashrate far below reported one points to hardware or DAG problems
+func (s *ProxyServer) isLowHashrate(ratio float64) bool {
+	return s.config.Proxy.HashrateDeviation > 0 && ratio < 1-s.config.Proxy.HashrateDeviation/100
+}
+
+// Miner is in warning state after half of client timeout without shares
+func (s *ProxyServer) minerState(lastBeat, now int64) (warning, timeout bool) {
+	warning = now-lastBeat > (int64(s.timeout/2) / 1000000)
+	timeout = now-lastBeat > (int64(s.timeout) / 1000000)
+	return
 }
 
 func (s *ProxyServer) getLuckStats() map[string]interface{} {
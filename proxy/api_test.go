@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+func purge(s *ProxyServer, method, contentType, body string) (int, map[string]interface{}) {
+	r := httptest.NewRequest(method, "/stats/purge", strings.NewReader(body))
+	if len(contentType) > 0 {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	s.PurgeMiners(w, r)
+	var reply map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	return w.Code, reply
+}
+
+func TestPurgeMiners(t *testing.T) {
+	s := newTestMinersServer(t)
+	now := util.MakeTimestamp()
+	addTestMiner(s, "rig1", now, now)
+	addTestMiner(s, "rig2", now, now)
+	addTestMiner(s, "rig3", now, now-int64(time.Hour/time.Millisecond))
+
+	if code, _ := purge(s, "POST", "application/json", `{"ids":["rig1"]}`); code != http.StatusForbidden {
+		t.Errorf("Expected purge forbidden without frontend password, got %v", code)
+	}
+	s.config.Frontend.Password = "secret"
+	for _, v := range []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"GET", "GET", "", "", http.StatusMethodNotAllowed},
+		{"form", "POST", "application/x-www-form-urlencoded", `ids=rig1`, http.StatusUnsupportedMediaType},
+		{"text", "POST", "text/plain", `{"ids":["rig1"]}`, http.StatusUnsupportedMediaType},
+		{"malformed", "POST", "application/json", `{"ids":`, http.StatusBadRequest},
+	} {
+		if code, _ := purge(s, v.method, v.contentType, v.body); code != v.code {
+			t.Errorf("%s: expected %v, got %v", v.name, v.code, code)
+		}
+	}
+	if _, ok := s.miners.Get("rig1"); !ok {
+		t.Fatal("Miner was purged by rejected request")
+	}
+
+	if code, reply := purge(s, "POST", "application/json; charset=utf-8", `{"ids":["rig1","unknown"]}`); code != http.StatusOK || reply["purged"].(float64) != 1 {
+		t.Errorf("Expected one miner purged, got %v %v", code, reply)
+	}
+	// Without ids only timed out miners are purged
+	if code, reply := purge(s, "POST", "application/json", ``); code != http.StatusOK || reply["purged"].(float64) != 1 {
+		t.Errorf("Expected timed out miner purged, got %v %v", code, reply)
+	}
+	if _, ok := s.miners.Get("rig2"); !ok {
+		t.Error("Online miner was purged")
+	}
+	if _, ok := s.miners.Get("rig3"); ok {
+		t.Error("Timed out miner was not purged")
+	}
+}
+
+func TestConvertMinerInfo(t *testing.T) {
+	s := newTestMinersServer(t)
+	s.config.Proxy.HashrateDeviation = 30
+	now := util.MakeTimestamp()
+	m := addTestMiner(s, "rig1", now-int64(time.Hour/time.Millisecond), now)
+	m.updateInfo(&Session{userAgent: "ethminer-0.9.41", protocol: "getwork/http-1.1", jsonrpc: "2.0", batch: true, worker: "gpu"})
+	m.setReportedHashrate(100000000)
+	// Half of reported 100 MH/s over 15 minutes window
+	m.shares[now-1000] = 50000 * int64(s.hashrateWindow/time.Millisecond)
+
+	stats := s.convertMiner(m, now)
+	for k, v := range map[string]interface{}{
+		"userAgent":        "ethminer-0.9.41",
+		"protocol":         "getwork/http-1.1/batch/jsonrpc-2.0",
+		"worker":           "gpu",
+		"reportedHashrate": uint64(100000000),
+		"effectiveRatio":   0.5,
+		"lowHashrate":      true,
+	} {
+		if stats[k] != v {
+			t.Errorf("Expected %s %v, got %v", k, v, stats[k])
+		}
+	}
+
+	s.config.Proxy.HashrateDeviation = 60
+	if stats := s.convertMiner(m, now); stats["lowHashrate"] != nil {
+		t.Error("Ratio within deviation must not be flagged")
+	}
+}
@@ -1,13 +1,17 @@
 package proxy
 
 import (
-	"../util"
+	"fmt"
 	"log"
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+
+	"../rpc"
+	"../util"
 )
 
 const maxBacklog = 8
@@ -40,22 +44,44 @@ func (b Block) Nonce() uint64            { return b.nonce }
 func (b Block) MixDigest() common.Hash   { return b.mixDigest }
 func (b Block) NumberU64() uint64        { return b.number }
 
+// Reply of upstream check made during the last half of refresh interval is as good as a new one
 func (s *ProxyServer) fetchBlockTemplate() {
+	s.refreshBlockTemplate(s.refreshInterval / 2)
+}
+
+// Zero maxAge requests work made after the call, e.g. when block was found
+func (s *ProxyServer) refreshBlockTemplate(maxAge time.Duration) {
 	rpc := s.rpc()
-	reply, err := rpc.GetWork()
+	// Work of a node mining to a wrong address is never served
+	if rpc.CoinbaseMismatch() {
+		return
+	}
+	t, err := fetchTemplate(rpc, s.currentBlockTemplate(), maxAge)
 	if err != nil {
 		log.Printf("Error while refreshing block template on %s: %s", rpc.Name, err)
 		return
 	}
-	t := s.currentBlockTemplate()
 	// No need to update, we have fresh job
-	if t != nil && t.Header == reply[0] {
+	if t == nil {
 		return
 	}
-	height, diff, err := s.fetchPendingBlock()
+	s.blockTemplate.Store(t)
+	s.pruneSubmits(t.Height)
+}
+
+// Returns new template with headers backlog of current one, nil if current one is still fresh.
+// Nothing else is requested unless header changes.
+func fetchTemplate(rpc *rpc.RPCClient, t *BlockTemplate, maxAge time.Duration) (*BlockTemplate, error) {
+	reply, err := rpc.GetRecentWork(maxAge)
 	if err != nil {
-		log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
-		return
+		return nil, err
+	}
+	if t != nil && t.Header == reply[0] {
+		return nil, nil
+	}
+	height, diff, err := workHeightDiff(rpc, reply)
+	if err != nil {
+		return nil, err
 	}
 
 	newTemplate := BlockTemplate{
@@ -70,31 +96,56 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	newTemplate.headers[reply[0]] = heightDiffPair{diff: util.TargetHexToDiff(reply[2]), height: height}
 	if t != nil {
 		for k, v := range t.headers {
-			if v.height > height-maxBacklog {
+			if height <= maxBacklog || v.height > height-maxBacklog {
 				newTemplate.headers[k] = v
 			}
 		}
 	}
-	s.blockTemplate.Store(&newTemplate)
 	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
+	return &newTemplate, nil
 }
 
-func (s *ProxyServer) fetchPendingBlock() (uint64, *big.Int, error) {
-	rpc := s.rpc()
+// Modern nodes reply with block number as the 4th getWork element and their target is derived
+// from network difficulty, so pending block is only needed for old nodes and pools, whose target is a share one.
+// Difficulty taken from target is approximate, 2^256 / target is rounded down and may be off by one.
+func workHeightDiff(rpc *rpc.RPCClient, reply []string) (uint64, *big.Int, error) {
+	// Zero target would divide by zero and can't be mined anyway
+	if new(big.Int).SetBytes(common.FromHex(reply[2])).Sign() == 0 {
+		return 0, nil, fmt.Errorf("zero getWork target %v", reply[2])
+	}
+	if len(reply) > 3 && !rpc.Pool {
+		height, err := parseHexUint64(reply[3])
+		if err == nil {
+			return height, util.TargetHexToDiff(reply[2]), nil
+		}
+		log.Printf("Can't parse getWork block number %v from %s: %v", reply[3], rpc.Name, err)
+	}
+	height, diff, err := fetchPendingBlock(rpc)
+	if err != nil {
+		return 0, nil, fmt.Errorf("pending block: %v", err)
+	}
+	return height, diff, nil
+}
+
+func fetchPendingBlock(rpc *rpc.RPCClient) (uint64, *big.Int, error) {
 	reply, err := rpc.GetPendingBlock()
 	if err != nil {
 		return 0, nil, err
 	}
-	blockNumber, err := strconv.ParseUint(strings.Replace(reply.Number, "0x", "", -1), 16, 64)
+	blockNumber, err := parseHexUint64(reply.Number)
 	if err != nil {
 		log.Println("Can't parse pending block number")
 		return 0, nil, err
 	}
-	blockDiff, err := strconv.ParseInt(strings.Replace(reply.Difficulty, "0x", "", -1), 16, 64)
-	if err != nil {
+	blockDiff, ok := new(big.Int).SetString(strings.TrimPrefix(reply.Difficulty, "0x"), 16)
+	if !ok || blockDiff.Sign() < 0 {
 		log.Println("Can't parse pending block difficulty")
-		return 0, nil, err
+		return 0, nil, fmt.Errorf("invalid difficulty %v", reply.Difficulty)
 	}
 
-	return blockNumber, big.NewInt(blockDiff), nil
+	return blockNumber, blockDiff, nil
+}
+
+func parseHexUint64(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
 }
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"../rpc"
+)
+
+func TestWorkHeightDiff(t *testing.T) {
+	client, err := rpc.NewRPCClient("geth", "http://127.0.0.1:1", "1s", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "0x" + strings.Repeat("ab", 32)
+	height, diff, err := workHeightDiff(client, []string{header, header, "0x" + strings.Repeat("00", 2) + strings.Repeat("ff", 30), "0x10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 16 || diff.Int64() != 65536 {
+		t.Errorf("Expected height 16 and difficulty 65536, got %v and %v", height, diff)
+	}
+
+	for _, target := range []string{"0x" + strings.Repeat("00", 32), "0x", ""} {
+		if _, _, err := workHeightDiff(client, []string{header, header, target, "0x10"}); err == nil {
+			t.Errorf("Expected error for zero target %q", target)
+		}
+	}
+}
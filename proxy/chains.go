@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"../util"
+)
+
+const defaultChain = "eth"
+
+// Config of additional chain. It shares everything with the default one except
+// upstreams, fee, block reward and files of stateful services, which get chain name appended.
+func (cfg *Config) ForChain(chain *Chain) *Config {
+	c := *cfg
+	c.Chain = chain.Name
+	c.Prefix = "/" + chain.Name
+	// Additional chain has no chains of its own
+	c.Chains = nil
+	// Copy of config must not share slices with the chain section it's made of
+	c.Upstream = copyUpstreams(chain.Upstream)
+	// Fee upstream mines a particular chain, so it's never inherited
+	c.Fee = chain.Fee
+	if len(chain.UpstreamCheckInterval) > 0 {
+		c.UpstreamCheckInterval = chain.UpstreamCheckInterval
+	}
+	if len(chain.BlockReward) > 0 {
+		c.BlockReward = chain.BlockReward
+	}
+	c.Journal.Path = chainPath(c.Journal.Path, chain.Name)
+	c.History.Path = chainPath(c.History.Path, chain.Name)
+	c.SubPool.Path = chainPath(c.SubPool.Path, chain.Name)
+	c.Payouts.Path = chainPath(c.Payouts.Path, chain.Name)
+	c.Proxy.MinerArchive = chainPath(c.Proxy.MinerArchive, chain.Name)
+	return &c
+}
+
+func copyUpstreams(upstreams []Upstream) []Upstream {
+	result := make([]Upstream, len(upstreams))
+	for i, v := range upstreams {
+		result[i] = v
+		result[i].Schedule = append([]string(nil), v.Schedule...)
+	}
+	return result
+}
+
+// Returns config of enabled chain by name, empty name stands for the default chain
+func (cfg *Config) ChainConfig(name string) (*Config, bool) {
+	if len(name) == 0 || name == cfg.defaultChain() {
+		return cfg, true
+	}
+	for i := range cfg.Chains {
+		if cfg.Chains[i].Enabled && cfg.Chains[i].Name == name {
+			return cfg.ForChain(&cfg.Chains[i]), true
+		}
+	}
+	return nil, false
+}
+
+func (cfg *Config) defaultChain() string {
+	if len(cfg.Chain) > 0 {
+		return cfg.Chain
+	}
+	return defaultChain
+}
+
+// Inserts chain name before extension, e.g. history.json => history.etc.json
+func chainPath(path, chain string) string {
+	if len(path) == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + chain + ext
+}
+
+// Independent proxy endpoints per chain, the default one serves /miner/ path
+type ChainSet struct {
+	names    []string
+	servers  map[string]*ProxyServer
+	switcher *Switcher
+}
+
+func NewChainSet(cfg *Config) *ChainSet {
+	c := &ChainSet{servers: make(map[string]*ProxyServer)}
+	name := cfg.defaultChain()
+	c.add(name, NewEndpoint(cfg))
+	for i := range cfg.Chains {
+		chain := &cfg.Chains[i]
+		if !chain.Enabled {
+			continue
+		}
+		if len(chain.Name) == 0 || strings.ContainsAny(chain.Name, "/?#") {
+			log.Fatalf("Invalid chain name: %q", chain.Name)
+		}
+		if _, ok := c.servers[chain.Name]; ok {
+			log.Fatalf("Duplicate chain name: %s", chain.Name)
+		}
+		log.Printf("Starting %s chain at %s/miner/", chain.Name, "/"+chain.Name)
+		c.add(chain.Name, NewEndpoint(cfg.ForChain(chain)))
+	}
+	if cfg.Switching.Enabled {
+		c.switcher = NewSwitcher(&cfg.Switching, c)
+	}
+	return c
+}
+
+func (c *ChainSet) add(name string, s *ProxyServer) {
+	c.names = append(c.names, name)
+	c.servers[name] = s
+}
+
+func (c *ChainSet) Default() *ProxyServer {
+	return c.servers[c.names[0]]
+}
+
+// Profit switching endpoint, nil unless enabled
+func (c *ChainSet) Switcher() *Switcher {
+	return c.switcher
+}
+
+func (c *ChainSet) SwitchingStats(w http.ResponseWriter, r *http.Request) {
+	c.switcher.SwitchingStats(w, r)
+}
+
+func (c *ChainSet) Servers() []*ProxyServer {
+	result := make([]*ProxyServer, len(c.names))
+	for i, name := range c.names {
+		result[i] = c.servers[name]
+	}
+	return result
+}
+
+// Dispatches stats request to chain given by ?chain= param, default chain if omitted
+func (c *ChainSet) Handle(f func(*ProxyServer, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("chain")
+		if len(name) == 0 {
+			name = c.names[0]
+		}
+		s, ok := c.servers[name]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Chain not found"})
+			return
+		}
+		f(s, w, r)
+	}
+}
+
+func (c *ChainSet) ChainsStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	var chains []interface{}
+	for _, name := range c.names {
+		s := c.servers[name]
+		hashrate, hashrate24h, totalOnline, miners, _ := s.collectMinersStats(nil)
+		t := s.currentBlockTemplate()
+		chains = append(chains, map[string]interface{}{
+			"name":        name,
+			"url":         s.minerUrl(),
+			"hashrate":    hashrate,
+			"hashrate24h": hashrate24h,
+			"totalMiners": len(miners),
+			"totalOnline": totalOnline,
+			"height":      t.Height,
+			"diff":        t.Difficulty,
+			"upstream":    s.rpc().Name,
+			"sick":        s.rpc().Sick(),
+			"blocks":      atomic.LoadUint64(&s.blocks),
+			"luck":        s.getLuckStats(),
+		})
+	}
+	stats := map[string]interface{}{
+		"chains": chains,
+		"now":    util.MakeTimestamp(),
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+// State of additional chains is nested into the default chain snapshot
+func (c *ChainSet) Snapshot() *Snapshot {
+	snap := c.Default().Snapshot()
+	for _, name := range c.names[1:] {
+		if snap.Chains == nil {
+			snap.Chains = make(map[string]*Snapshot)
+		}
+		snap.Chains[name] = c.servers[name].Snapshot()
+	}
+	return snap
+}
+
+// Every chain merges its saved state, even if parent process had no such chain
+func (c *ChainSet) Restore(snap *Snapshot) {
+	c.Default().Restore(snap)
+	for _, name := range c.names[1:] {
+		v, ok := snap.Chains[name]
+		if !ok {
+			v = &Snapshot{}
+		}
+		c.servers[name].Restore(v)
+	}
+	for name := range snap.Chains {
+		if _, ok := c.servers[name]; !ok {
+			log.Printf("Dropped state of removed chain %s", name)
+		}
+	}
+}
+
+func (c *ChainSet) Shutdown(ctx context.Context) error {
+	c.switcher.Stop()
+	var err error
+	for _, name := range c.names {
+		if serr := c.servers[name].Shutdown(ctx); serr != nil {
+			log.Printf("Chain %s shutdown incomplete: %v", name, serr)
+			err = serr
+		}
+	}
+	return err
+}
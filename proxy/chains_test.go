@@ -0,0 +1,39 @@
+package proxy
+
+import "testing"
+
+func TestForChain(t *testing.T) {
+	cfg := &Config{
+		Upstream: []Upstream{{Name: "eth-geth"}},
+		History:  History{Path: "history.json"},
+		Chains: []Chain{
+			{Enabled: true, Name: "etc", BlockReward: "4000000000000000000", Upstream: []Upstream{{Name: "etc-geth", Schedule: []string{"00:00-12:00"}}}},
+			{Name: "exp", Upstream: []Upstream{{Name: "exp-geth"}}},
+		},
+	}
+	c, ok := cfg.ChainConfig("etc")
+	if !ok {
+		t.Fatal("Enabled chain not found")
+	}
+	if c.Prefix != "/etc" || c.History.Path != "history.etc.json" || c.BlockReward != "4000000000000000000" {
+		t.Errorf("Wrong chain config: %+v", c)
+	}
+	if len(c.Chains) != 0 {
+		t.Errorf("Chain config must have no chains, got %v", len(c.Chains))
+	}
+	c.Upstream[0].Name = "changed"
+	c.Upstream[0].Schedule[0] = "changed"
+	if u := cfg.Chains[0].Upstream[0]; u.Name != "etc-geth" || u.Schedule[0] != "00:00-12:00" {
+		t.Errorf("Chain section was modified through its config: %+v", u)
+	}
+	if cfg.History.Path != "history.json" {
+		t.Errorf("Default chain config was modified: %v", cfg.History.Path)
+	}
+
+	if _, ok := cfg.ChainConfig("exp"); ok {
+		t.Error("Disabled chain must not be found")
+	}
+	if c, ok := cfg.ChainConfig(""); !ok || c != cfg {
+		t.Error("Empty name must return default chain config")
+	}
+}
@@ -3,8 +3,19 @@ package proxy
 type Config struct {
 	Proxy                 Proxy      `json:"proxy"`
 	Frontend              Frontend   `json:"frontend"`
+	Chain                 string     `json:"chain"`
+	BlockReward           string     `json:"blockReward"`
 	Upstream              []Upstream `json:"upstream"`
 	UpstreamCheckInterval string     `json:"upstreamCheckInterval"`
+	Chains                []Chain    `json:"chains"`
+	Switching             Switching  `json:"switching"`
+	Journal               Journal    `json:"journal"`
+	Alerts                Alerts     `json:"alerts"`
+	History               History    `json:"history"`
+	Groups                Groups     `json:"groups"`
+	SubPool               SubPool    `json:"subpool"`
+	Payouts               Payouts    `json:"payouts"`
+	Fee                   Fee        `json:"fee"`
 
 	Threads int `json:"threads"`
 
@@ -12,16 +23,36 @@ type Config struct {
 	NewrelicKey     string `json:"newrelicKey"`
 	NewrelicVerbose bool   `json:"newrelicVerbose"`
 	NewrelicEnabled bool   `json:"newrelicEnabled"`
+
+	// Path prefix of miner endpoint, set for additional chains only
+	Prefix string `json:"-"`
+	// Set in process started by upgrade, saved state is merged by Restore instead of loaded on start
+	Inherited bool `json:"-"`
 }
 
 type Proxy struct {
-	Listen               string `json:"listen"`
-	ClientTimeout        string `json:"clientTimeout"`
-	BlockRefreshInterval string `json:"blockRefreshInterval"`
-	HashrateWindow       string `json:"hashrateWindow"`
-	SubmitHashrate       bool   `json:"submitHashrate"`
-	LuckWindow           string `json:"luckWindow"`
-	LargeLuckWindow      string `json:"largeLuckWindow"`
+	Listen                 string  `json:"listen"`
+	ClientTimeout          string  `json:"clientTimeout"`
+	BlockRefreshInterval   string  `json:"blockRefreshInterval"`
+	HashrateWindow         string  `json:"hashrateWindow"`
+	SubmitHashrate         bool    `json:"submitHashrate"`
+	HashrateDeviation      float64 `json:"hashrateDeviation"`
+	SubmitHashrateInterval string  `json:"submitHashrateInterval"`
+	LuckWindow             string  `json:"luckWindow"`
+	LargeLuckWindow        string  `json:"largeLuckWindow"`
+	ShutdownTimeout        string  `json:"shutdownTimeout"`
+	MinerRetention         string  `json:"minerRetention"`
+	MinerArchive           string  `json:"minerArchive"`
+	AddressIds             bool    `json:"addressIds"`
+}
+
+type Chain struct {
+	Enabled               bool       `json:"enabled"`
+	Name                  string     `json:"name"`
+	Upstream              []Upstream `json:"upstream"`
+	UpstreamCheckInterval string     `json:"upstreamCheckInterval"`
+	BlockReward           string     `json:"blockReward"`
+	Fee                   Fee        `json:"fee"`
 }
 
 type Frontend struct {
@@ -31,8 +62,105 @@ type Frontend struct {
 }
 
 type Upstream struct {
-	Name    string `json:"name"`
+	Name      string   `json:"name"`
+	Url       string   `json:"url"`
+	Timeout   string   `json:"timeout"`
+	Pool      bool     `json:"pool"`
+	Etherbase string   `json:"etherbase"`
+	Schedule  []string `json:"schedule"`
+	Timezone  string   `json:"timezone"`
+}
+
+type Journal struct {
+	Enabled   bool   `json:"enabled"`
+	Path      string `json:"path"`
+	MaxSize   int64  `json:"maxSize"`
+	MaxAge    string `json:"maxAge"`
+	MaxFiles  int    `json:"maxFiles"`
+	Retention string `json:"retention"`
+}
+
+type Alerts struct {
+	Enabled      bool            `json:"enabled"`
+	Interval     string          `json:"interval"`
+	HashrateDrop float64         `json:"hashrateDrop"`
+	Webhooks     []WebhookConfig `json:"webhooks"`
+	SMTP         SMTP            `json:"smtp"`
+}
+
+type WebhookConfig struct {
 	Url     string `json:"url"`
+	Format  string `json:"format"`
+	ChatId  string `json:"chatId"`
 	Timeout string `json:"timeout"`
-	Pool    bool   `json:"pool"`
+}
+
+type SMTP struct {
+	Enabled    bool            `json:"enabled"`
+	Address    string          `json:"address"`
+	Username   string          `json:"username"`
+	Password   string          `json:"password"`
+	From       string          `json:"from"`
+	RateLimit  string          `json:"rateLimit"`
+	Recipients []MailRecipient `json:"recipients"`
+}
+
+type MailRecipient struct {
+	To     string   `json:"to"`
+	Events []string `json:"events"`
+	Digest string   `json:"digest"`
+}
+
+type History struct {
+	Enabled         bool   `json:"enabled"`
+	Path            string `json:"path"`
+	SaveInterval    string `json:"saveInterval"`
+	MinuteRetention string `json:"minuteRetention"`
+	HourRetention   string `json:"hourRetention"`
+	DayRetention    string `json:"dayRetention"`
+}
+
+type Groups struct {
+	Separator string   `json:"separator"`
+	Levels    []string `json:"levels"`
+	File      string   `json:"file"`
+}
+
+type SubPool struct {
+	Enabled      bool    `json:"enabled"`
+	Scheme       string  `json:"scheme"`
+	PPLNSWindow  float64 `json:"pplnsWindow"`
+	GroupBy      string  `json:"groupBy"`
+	Fee          float64 `json:"fee"`
+	Path         string  `json:"path"`
+	SaveInterval string  `json:"saveInterval"`
+}
+
+type Payouts struct {
+	Enabled   bool              `json:"enabled"`
+	Path      string            `json:"path"`
+	Threshold string            `json:"threshold"`
+	Addresses map[string]string `json:"addresses"`
+}
+
+type Switching struct {
+	Enabled    bool            `json:"enabled"`
+	Path       string          `json:"path"`
+	Interval   string          `json:"interval"`
+	Hysteresis float64         `json:"hysteresis"`
+	MinDwell   string          `json:"minDwell"`
+	PriceFeed  PriceFeedConfig `json:"priceFeed"`
+}
+
+type PriceFeedConfig struct {
+	Url     string `json:"url"`
+	Path    string `json:"path"`
+	Timeout string `json:"timeout"`
+}
+
+type Fee struct {
+	Enabled  bool     `json:"enabled"`
+	Upstream Upstream `json:"upstream"`
+	Period   string   `json:"period"`
+	Duration string   `json:"duration"`
 }
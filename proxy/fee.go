@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../rpc"
+	"../util"
+)
+
+// Dedicates duration out of every period of farm hashrate to fee upstream.
+// During a slice miners get work of fee upstream, shares for this work are
+// submitted there no matter when they arrive.
+type FeeSlicer struct {
+	sync.RWMutex
+	upstream      *rpc.RPCClient
+	period        time.Duration
+	duration      time.Duration
+	refresh       time.Duration
+	blockTemplate atomic.Value
+	active        bool
+	activeSince   time.Time
+	refreshTicker *time.Ticker
+	startedAt     time.Time
+	elapsed       time.Duration
+	feeTime       time.Duration
+	slices        uint64
+	skipped       uint64
+	feeWork       int64
+	totalWork     int64
+}
+
+type FeeSnapshot struct {
+	Timestamp int64            `json:"timestamp"`
+	Upstream  UpstreamSnapshot `json:"upstream"`
+	Elapsed   int64            `json:"elapsed"`
+	FeeTime   int64            `json:"feeTime"`
+	Slices    uint64           `json:"slices"`
+	Skipped   uint64           `json:"skipped"`
+	FeeWork   int64            `json:"feeWork"`
+	TotalWork int64            `json:"totalWork"`
+}
+
+func NewFeeSlicer(cfg *Fee, refresh time.Duration, quit chan struct{}) *FeeSlicer {
+	u := cfg.Upstream
+	// Slices are timed by period, fee upstream is never checked against a schedule
+	if len(u.Schedule) > 0 {
+		log.Fatalf("Fee upstream %s can't have schedule", u.Name)
+	}
+	client, err := rpc.NewRPCClient(u.Name, u.Url, u.Timeout, u.Etherbase, u.Pool)
+	if err != nil {
+		log.Fatalf("Invalid fee upstream: %v", err)
+	}
+	f := &FeeSlicer{upstream: client, refresh: refresh, startedAt: time.Now()}
+	f.period, err = time.ParseDuration(cfg.Period)
+	if err != nil {
+		log.Fatalf("Invalid fee period: %v", err)
+	}
+	f.duration, err = time.ParseDuration(cfg.Duration)
+	if err != nil || f.duration <= 0 || f.duration >= f.period {
+		log.Fatalf("Invalid fee duration %v, must be positive and shorter than period", cfg.Duration)
+	}
+	f.blockTemplate.Store(&BlockTemplate{})
+	go f.run(quit)
+	return f
+}
+
+// Slice starts after farm part of the period, so restarts never mine fee first
+func (f *FeeSlicer) run(quit chan struct{}) {
+	timer := time.NewTimer(f.period - f.duration)
+	for {
+		// Template is refreshed during slices only
+		var refresh <-chan time.Time
+		f.RLock()
+		if f.refreshTicker != nil {
+			refresh = f.refreshTicker.C
+		}
+		f.RUnlock()
+
+		select {
+		case <-quit:
+			timer.Stop()
+			f.stop()
+			return
+		case <-timer.C:
+			if f.isActive() {
+				f.stop()
+				timer.Reset(f.period - f.duration)
+			} else if f.start() {
+				timer.Reset(f.duration)
+			} else {
+				timer.Reset(f.period - f.duration)
+			}
+		case <-refresh:
+			if _, err := f.fetchTemplate(f.refresh / 2); err != nil {
+				log.Printf("Fee slice ended early, %s failed: %v", f.upstream.Name, err)
+				f.stop()
+				timer.Reset(f.period - f.duration)
+			}
+		}
+	}
+}
+
+// Slice is skipped if fee upstream has no work for us or mines to a wrong address
+func (f *FeeSlicer) start() bool {
+	err := f.upstream.VerifyCoinbase()
+	if err == nil {
+		_, err = f.fetchTemplate(f.refresh / 2)
+	}
+	if err != nil {
+		log.Printf("Fee slice skipped, %s failed: %v", f.upstream.Name, err)
+		f.Lock()
+		f.skipped++
+		f.Unlock()
+		return false
+	}
+	f.Lock()
+	f.active = true
+	f.activeSince = time.Now()
+	f.refreshTicker = time.NewTicker(f.refresh)
+	f.slices++
+	f.Unlock()
+	log.Printf("Fee slice started on %s for %v", f.upstream.Name, f.duration)
+	return true
+}
+
+func (f *FeeSlicer) stop() {
+	f.Lock()
+	defer f.Unlock()
+	if !f.active {
+		return
+	}
+	f.active = false
+	f.refreshTicker.Stop()
+	f.refreshTicker = nil
+	d := time.Since(f.activeSince)
+	f.feeTime += d
+	log.Printf("Fee slice on %s finished after %v", f.upstream.Name, d)
+}
+
+func (f *FeeSlicer) isActive() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.active
+}
+
+// Returns error if upstream has no valid work, nil template if current one is fresh
+func (f *FeeSlicer) fetchTemplate(maxAge time.Duration) (*BlockTemplate, error) {
+	t, err := fetchTemplate(f.upstream, f.currentBlockTemplate(), maxAge)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		f.blockTemplate.Store(t)
+	}
+	return t, nil
+}
+
+func (f *FeeSlicer) currentBlockTemplate() *BlockTemplate {
+	return f.blockTemplate.Load().(*BlockTemplate)
+}
+
+// Template to hand out to miners, nil outside of fee slice
+func (f *FeeSlicer) work() *BlockTemplate {
+	if f == nil || !f.isActive() {
+		return nil
+	}
+	t := f.currentBlockTemplate()
+	if len(t.Header) == 0 {
+		return nil
+	}
+	return t
+}
+
+// Returns fee template if share is for fee work
+func (f *FeeSlicer) lookup(header string) *BlockTemplate {
+	if f == nil {
+		return nil
+	}
+	t := f.currentBlockTemplate()
+	if _, ok := t.headers[header]; ok {
+		return t
+	}
+	return nil
+}
+
+func (f *FeeSlicer) owns(upstream *rpc.RPCClient) bool {
+	return f != nil && f.upstream == upstream
+}
+
+// Counts work of every valid share, fee or not, to know delivered fraction
+func (f *FeeSlicer) countShare(fee bool, work int64) {
+	if f == nil {
+		return
+	}
+	if fee {
+		atomic.AddInt64(&f.feeWork, work)
+	}
+	atomic.AddInt64(&f.totalWork, work)
+}
+
+// Total and fee time including ongoing slice and time before binary upgrade
+func (f *FeeSlicer) times() (elapsed, feeTime time.Duration) {
+	f.RLock()
+	defer f.RUnlock()
+	now := time.Now()
+	elapsed = f.elapsed + now.Sub(f.startedAt)
+	feeTime = f.feeTime
+	if f.active {
+		feeTime += now.Sub(f.activeSince)
+	}
+	return
+}
+
+func (f *FeeSlicer) stats() map[string]interface{} {
+	elapsed, feeTime := f.times()
+	feeWork := atomic.LoadInt64(&f.feeWork)
+	totalWork := atomic.LoadInt64(&f.totalWork)
+	f.RLock()
+	defer f.RUnlock()
+	stats := map[string]interface{}{
+		"upstream":     convertUpstream(f.upstream),
+		"active":       f.active,
+		"period":       f.period.String(),
+		"duration":     f.duration.String(),
+		"target":       float64(f.duration) / float64(f.period),
+		"elapsed":      int64(elapsed / time.Millisecond),
+		"feeTime":      int64(feeTime / time.Millisecond),
+		"timeFraction": float64(feeTime) / float64(elapsed),
+		"slices":       f.slices,
+		"skipped":      f.skipped,
+		"feeWork":      feeWork,
+		"totalWork":    totalWork,
+	}
+	if totalWork > 0 {
+		stats["workFraction"] = float64(feeWork) / float64(totalWork)
+	}
+	return stats
+}
+
+func (f *FeeSlicer) snapshot() *FeeSnapshot {
+	if f == nil {
+		return nil
+	}
+	elapsed, feeTime := f.times()
+	f.RLock()
+	defer f.RUnlock()
+	return &FeeSnapshot{
+		Timestamp: util.MakeTimestamp(),
+		Upstream:  snapshotUpstream(f.upstream),
+		Elapsed:   int64(elapsed / time.Millisecond),
+		FeeTime:   int64(feeTime / time.Millisecond),
+		Slices:    f.slices,
+		Skipped:   f.skipped,
+		FeeWork:   atomic.LoadInt64(&f.feeWork),
+		TotalWork: atomic.LoadInt64(&f.totalWork),
+	}
+}
+
+// Accounting is carried over only if fee upstream is the same
+func (f *FeeSlicer) restore(fs *FeeSnapshot) {
+	if f == nil || fs == nil || fs.Upstream.Name != f.upstream.Name {
+		return
+	}
+	restoreUpstream(f.upstream, &fs.Upstream)
+	f.Lock()
+	// Both processes were running while parent drained, that time is counted once
+	elapsed := time.Duration(fs.Elapsed) * time.Millisecond
+	if overlap := time.Duration(fs.Timestamp)*time.Millisecond - time.Duration(f.startedAt.UnixNano()); overlap > 0 && overlap < elapsed {
+		elapsed -= overlap
+	}
+	f.elapsed += elapsed
+	f.feeTime += time.Duration(fs.FeeTime) * time.Millisecond
+	f.slices += fs.Slices
+	f.skipped += fs.Skipped
+	f.Unlock()
+	atomic.AddInt64(&f.feeWork, fs.FeeWork)
+	atomic.AddInt64(&f.totalWork, fs.TotalWork)
+}
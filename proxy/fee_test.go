@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"../util"
+)
+
+func newTestFeeSlicer(t *testing.T, n *testNode) *FeeSlicer {
+	quit := make(chan struct{})
+	t.Cleanup(func() { close(quit) })
+	return NewFeeSlicer(&Fee{Period: "1h", Duration: "36s", Upstream: Upstream{Name: "fee", Url: n.URL, Timeout: "5s"}}, time.Minute, quit)
+}
+
+func TestFeeSlice(t *testing.T) {
+	n := newTestNode(t)
+	f := newTestFeeSlicer(t, n)
+	if f.work() != nil {
+		t.Fatal("Fee work must not be served outside of slice")
+	}
+	if !f.start() {
+		t.Fatal("Expected slice to start")
+	}
+	if w := f.work(); w == nil || w.Header != testHeader || f.lookup(testHeader) == nil {
+		t.Fatalf("Expected fee work during slice, got %+v", w)
+	}
+	time.Sleep(50 * time.Millisecond)
+	f.stop()
+	// Shares for fee work are still accepted after slice ended
+	if f.work() != nil || f.lookup(testHeader) == nil {
+		t.Error("Expected fee work stopped and its shares still recognized")
+	}
+
+	elapsed, feeTime := f.times()
+	if feeTime < 50*time.Millisecond || feeTime > elapsed {
+		t.Errorf("Wrong fee time %v of %v", feeTime, elapsed)
+	}
+	// Stopped slice is not counted again
+	f.stop()
+	if _, again := f.times(); again != feeTime {
+		t.Errorf("Fee time changed after slice ended: %v, %v", feeTime, again)
+	}
+
+	f.countShare(true, 10)
+	f.countShare(false, 30)
+	if stats := f.stats(); stats["slices"].(uint64) != 1 || stats["workFraction"].(float64) != 0.25 {
+		t.Errorf("Wrong fee stats: %v", stats)
+	}
+}
+
+func TestFeeRestore(t *testing.T) {
+	n := newTestNode(t)
+	f := newTestFeeSlicer(t, n)
+
+	// Parent ran for 10s and kept serving for 2s after upgraded process started
+	now := time.Now()
+	f.startedAt = now.Add(-2 * time.Second)
+	fs := &FeeSnapshot{
+		Timestamp: util.MakeTimestamp(),
+		Upstream:  UpstreamSnapshot{Name: "fee", ValidShares: 5},
+		Elapsed:   10000,
+		FeeTime:   100,
+		Slices:    2,
+		FeeWork:   10,
+		TotalWork: 1000,
+	}
+	f.restore(fs)
+	elapsed, feeTime := f.times()
+	if elapsed < 10*time.Second || elapsed > 11*time.Second {
+		t.Errorf("Expected overlap counted once, got elapsed %v", elapsed)
+	}
+	if feeTime != 100*time.Millisecond || f.slices != 2 || f.totalWork != 1000 || f.upstream.ValidShares != 5 {
+		t.Errorf("Fee accounting was not restored: %v, %+v", feeTime, f.stats())
+	}
+
+	// State of another fee upstream is not carried over
+	fs.Upstream.Name = "other"
+	f.restore(fs)
+	if f.slices != 2 {
+		t.Errorf("Expected state of other upstream ignored, got %v slices", f.slices)
+	}
+}
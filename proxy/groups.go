@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Assigns miners to groups like site, rack or owner. Groups are taken from
+// id parts split by separator, metadata file entries take precedence.
+type MinerGroups struct {
+	separator string
+	levels    []string
+	meta      map[string]map[string]string
+}
+
+func NewMinerGroups(cfg *Groups) (*MinerGroups, error) {
+	g := &MinerGroups{separator: cfg.Separator, levels: cfg.Levels, meta: make(map[string]map[string]string)}
+	if len(cfg.File) > 0 {
+		f, err := os.Open(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&g.meta); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *MinerGroups) groupsOf(id string) map[string]string {
+	result := make(map[string]string)
+	if g == nil {
+		return result
+	}
+	name := id
+	if address, worker, err := parseAddressId(id); err == nil {
+		result["address"] = address
+		// Levels are taken from worker name, address is not a site
+		name = worker
+	}
+	if len(g.separator) > 0 && len(g.levels) > 0 && len(name) > 0 {
+		parts := strings.Split(name, g.separator)
+		// Last part is a rig name itself
+		for i := 0; i < len(parts)-1 && i < len(g.levels); i++ {
+			result[g.levels[i]] = parts[i]
+		}
+	}
+	for k, v := range g.meta[id] {
+		result[k] = v
+	}
+	return result
+}
+
+// Parses group filters in "level:name" form
+func parseGroupFilter(values []string) map[string]string {
+	filter := make(map[string]string)
+	for _, v := range values {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) == 2 {
+			filter[kv[0]] = kv[1]
+		}
+	}
+	return filter
+}
+
+func matchGroups(groups, filter map[string]string) bool {
+	for k, v := range filter {
+		if groups[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import "testing"
+
+func TestGroupsOf(t *testing.T) {
+	g := &MinerGroups{separator: ".", levels: []string{"site", "rack"}, meta: map[string]map[string]string{
+		"eu1.r3.rig7": {"owner": "alice", "rack": "r4"},
+	}}
+	address := "0xb85150eb365e7df0941f0cf08235f987ba91506a"
+	for _, v := range []struct {
+		id     string
+		groups map[string]string
+	}{
+		{"rig1", map[string]string{}},
+		{"eu1.r3.rig1", map[string]string{"site": "eu1", "rack": "r3"}},
+		{"eu1.rig1", map[string]string{"site": "eu1"}},
+		{"eu1.r3.rig7", map[string]string{"site": "eu1", "rack": "r4", "owner": "alice"}},
+		{address, map[string]string{"address": address}},
+		{address + ".rig1", map[string]string{"address": address}},
+		{address + ".eu1.r3.rig1", map[string]string{"address": address, "site": "eu1", "rack": "r3"}},
+	} {
+		groups := g.groupsOf(v.id)
+		if len(groups) != len(v.groups) {
+			t.Errorf("%s: expected %v, got %v", v.id, v.groups, groups)
+			continue
+		}
+		for k, name := range v.groups {
+			if groups[k] != name {
+				t.Errorf("%s: expected %v, got %v", v.id, v.groups, groups)
+			}
+		}
+	}
+}
@@ -3,18 +3,28 @@ package proxy
 import (
 	"log"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"../util"
 )
 
 func (s *ProxyServer) handleGetWorkRPC(cs *Session, diff, id string) (reply []string, errorReply *ErrorReply) {
-	t := s.currentBlockTemplate()
-	if len(t.Header) == 0 {
+	if miner, ok := s.miners.Get(id); ok {
+		miner.updateInfo(cs)
+	}
+	t, upstream := s.currentBlockTemplate(), s.rpc()
+	// Fee slice takes precedence over current upstream
+	if ft := s.fee.work(); ft != nil {
+		t, upstream = ft, s.fee.upstream
+	}
+	if len(t.Header) == 0 || upstream.CoinbaseMismatch() {
 		return nil, &ErrorReply{Code: -1, Message: "Work not ready"}
 	}
 	targetHex := t.Target
 
-	if !s.rpc().Pool {
+	if !upstream.Pool {
 		minerDifficulty, err := strconv.ParseFloat(diff, 64)
 		if err != nil {
 			log.Printf("Invalid difficulty %v from %v@%v ", diff, id, cs.ip)
@@ -26,24 +36,79 @@ func (s *ProxyServer) handleGetWorkRPC(cs *Session, diff, id string) (reply []st
 	return
 }
 
+// Login param is a wallet address, worker name comes in a separate field
+func (s *ProxyServer) handleLoginRPC(cs *Session, id, worker string, params []string) bool {
+	miner := s.getMiner(cs, id)
+	if len(worker) > 0 {
+		miner.setWorker(worker)
+	}
+	log.Printf("Miner %v@%v logged in with %v, worker %v", id, cs.ip, params[0], worker)
+	return true
+}
+
 func (s *ProxyServer) handleSubmitRPC(cs *Session, diff string, id string, params []string) (reply bool, errorReply *ErrorReply) {
+	miner := s.getMiner(cs, id)
+	if ft := s.fee.lookup(params[1]); ft != nil {
+		return miner.processShare(s, cs.ip, s.fee.upstream, ft, diff, params)
+	}
+	// Upstream may be switched concurrently, checked one must get the share
+	upstream := s.rpc()
+	if upstream.CoinbaseMismatch() {
+		log.Printf("Refused share from %v@%v, upstream %v mines to wrong etherbase", id, cs.ip, upstream.Name)
+		return false, &ErrorReply{Code: -1, Message: "Upstream coinbase mismatch"}
+	}
+	t := s.currentBlockTemplate()
+	return miner.processShare(s, cs.ip, upstream, t, diff, params)
+}
+
+// Reported hashrate is kept locally, upstream receives aggregated value from submitHashrate
+func (s *ProxyServer) handleSubmitHashrate(cs *Session, id string, params []string) bool {
+	miner := s.getMiner(cs, id)
+	hashrate, err := strconv.ParseUint(strings.Replace(params[0], "0x", "", -1), 16, 64)
+	if err != nil {
+		log.Printf("Malformed hashrate %v from %v@%v", params[0], id, cs.ip)
+		return false
+	}
+	miner.setReportedHashrate(hashrate)
+	return true
+}
+
+// Returns registered miner or registers a new one, client info is refreshed
+func (s *ProxyServer) getMiner(cs *Session, id string) *Miner {
 	miner, ok := s.miners.Get(id)
 	if !ok {
 		miner = NewMiner(id, cs.ip)
 		s.registerMiner(miner)
 	}
-
-	t := s.currentBlockTemplate()
-	reply = miner.processShare(s, t, diff, params)
-	return
-}
-
-func (s *ProxyServer) handleSubmitHashrate(cs *Session, req *JSONRpcReq) bool {
-	reply, _ := s.rpc().SubmitHashrate(req.Params)
-	return reply
+	miner.updateInfo(cs)
+	return miner
 }
 
 func (s *ProxyServer) handleUnknownRPC(cs *Session, req *JSONRpcReq) *ErrorReply {
 	log.Printf("Unknown RPC method: %v", req)
-	return &ErrorReply{Code: -1, Message: "Invalid method"}
+	return errMethodNotFound
+}
+
+// Submits sum of hashrate reported by online rigs to current upstream under a stable id
+func (s *ProxyServer) submitHashrate() {
+	now := util.MakeTimestamp()
+	window := int64(s.hashrateWindow / time.Millisecond)
+	total := uint64(0)
+	for m := range s.miners.Iter() {
+		info := m.Val.getInfo()
+		if _, timeout := s.minerState(m.Val.getLastBeat(), now); timeout || now-info.ReportedAt > window {
+			continue
+		}
+		total += info.ReportedHashrate
+	}
+
+	rpc := s.rpc()
+	params := []string{"0x" + strconv.FormatUint(total, 16), rpc.HashrateId}
+	_, err := rpc.SubmitHashrate(params)
+	if err != nil {
+		log.Printf("Unable to submit hashrate to %v: %v", rpc.Name, err)
+		return
+	}
+	atomic.StoreUint64(&rpc.Hashrate, total)
+	atomic.StoreInt64(&rpc.HashrateAt, now)
 }
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoginInfo(t *testing.T) {
+	s, url := newTestProxy(t, newTestNode(t), nil)
+	postAs(t, url, "ethminer-0.9.41", `{"id":1,"jsonrpc":"2.0","method":"eth_submitLogin","worker":"gpu-a","params":["0xb85150eb365e7df0941f0cf08235f987ba91506a"]}`)
+
+	m, ok := s.miners.Get("rig1")
+	if !ok {
+		t.Fatal("Miner was not registered on login")
+	}
+	info := m.getInfo()
+	if info.Worker != "gpu-a" || info.UserAgent != "ethminer-0.9.41" || info.Protocol != "getwork/http-1.1/jsonrpc-2.0" {
+		t.Errorf("Wrong miner info after login: %+v", info)
+	}
+
+	// Worker from login is kept, client details follow the last request
+	postAs(t, url, "claymore/9.7", `[{"id":1,"method":"eth_getWork"}]`)
+	if info := m.getInfo(); info.Worker != "gpu-a" || info.UserAgent != "claymore/9.7" || info.Protocol != "getwork/http-1.1/batch" {
+		t.Errorf("Wrong miner info after batch: %+v", info)
+	}
+}
+
+func TestSubmitHashrate(t *testing.T) {
+	n := newTestNode(t)
+	s, url := newTestProxy(t, n, nil)
+	rig2 := strings.Replace(url, "rig1", "rig2", 1)
+	rig3 := strings.Replace(url, "rig1", "rig3", 1)
+	post(t, url, `{"id":1,"jsonrpc":"2.0","method":"eth_submitHashrate","params":["0x100","0x01"]}`)
+	post(t, rig2, `{"id":1,"jsonrpc":"2.0","method":"eth_submitHashrate","params":["0x200","0x02"]}`)
+	post(t, rig3, `{"id":1,"jsonrpc":"2.0","method":"eth_submitHashrate","params":["0x400","0x03"]}`)
+	if _, body := post(t, url, `{"id":1,"jsonrpc":"2.0","method":"eth_submitHashrate","params":["zz","0x01"]}`); !strings.Contains(body, `"result":false`) {
+		t.Errorf("Expected malformed hashrate refused, got %s", body)
+	}
+	if n.callsOf("eth_submitHashrate") != 0 {
+		t.Fatal("Rig hashrate must not be forwarded upstream")
+	}
+
+	// Timed out rig3 is not counted
+	for _, id := range []string{"rig1", "rig2"} {
+		m, _ := s.miners.Get(id)
+		m.heartbeat()
+	}
+	if m, _ := s.miners.Get("rig1"); m.getInfo().ReportedHashrate != 0x100 {
+		t.Errorf("Expected last valid hashrate kept, got %v", m.getInfo().ReportedHashrate)
+	}
+	s.submitHashrate()
+	s.submitHashrate()
+	if len(n.hashrates) != 2 {
+		t.Fatalf("Expected 2 submissions, got %v", n.hashrates)
+	}
+	for _, params := range n.hashrates {
+		if len(params) != 2 || params[0] != "0x300" || params[1] != s.rpc().HashrateId {
+			t.Errorf("Expected sum with stable id %s, got %v", s.rpc().HashrateId, params)
+		}
+	}
+}
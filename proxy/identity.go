@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/sha3"
+)
+
+var (
+	errInvalidAddress  = errors.New("invalid miner address")
+	errAddressChecksum = errors.New("miner address checksum mismatch")
+)
+
+// Splits "address.worker" id and returns address in lowercase, the canonical form of ids and accounts.
+// Mixed case addresses must pass EIP-55 checksum, single case ones are accepted as is.
+func parseAddressId(id string) (address, worker string, err error) {
+	parts := strings.SplitN(id, ".", 2)
+	address = parts[0]
+	if len(parts) == 2 {
+		worker = parts[1]
+	}
+	if !strings.HasPrefix(address, "0x") || !common.IsHexAddress(address) {
+		return "", "", errInvalidAddress
+	}
+	lower := strings.ToLower(address)
+	if address[2:] != lower[2:] && address[2:] != strings.ToUpper(address[2:]) && address != checksumAddress(lower) {
+		return "", "", errAddressChecksum
+	}
+	return lower, worker, nil
+}
+
+// EIP-55 mixed case form of lowercase address
+func checksumAddress(address string) string {
+	sha := sha3.NewKeccak256()
+	sha.Write([]byte(address[2:]))
+	hash := hex.EncodeToString(sha.Sum(nil))
+	result := []byte(address)
+	for i := 2; i < len(result); i++ {
+		if result[i] >= 'a' && hash[i-2] >= '8' {
+			result[i] -= 'a' - 'A'
+		}
+	}
+	return string(result)
+}
+
+// Normalizes miner id from request path, only address ids are allowed in address mode
+func (s *ProxyServer) minerId(id string) (string, string, error) {
+	if !s.config.Proxy.AddressIds {
+		return id, "", nil
+	}
+	address, worker, err := parseAddressId(id)
+	if err != nil {
+		return "", "", err
+	}
+	if len(worker) > 0 {
+		return address + "." + worker, worker, nil
+	}
+	return address, "", nil
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import "testing"
+
+func TestParseAddressId(t *testing.T) {
+	const lower = "0xb85150eb365e7df0941f0cf08235f987ba91506a"
+	for _, v := range []struct {
+		id      string
+		address string
+		worker  string
+		err     error
+	}{
+		{"0xb85150eB365e7Df0941F0CF08235f987bA91506A", lower, "", nil},
+		{"0xb85150eB365e7df0941f0cF08235F987Ba91506a", "", "", errAddressChecksum},
+		{lower, lower, "", nil},
+		{"0xB85150EB365E7DF0941F0CF08235F987BA91506A", lower, "", nil},
+		{"b85150eb365e7df0941f0cf08235f987ba91506a", "", "", errInvalidAddress},
+		{"0xb85150eb365e7df0941f0cf08235f987ba9150", "", "", errInvalidAddress},
+		{"0xb85150eB365e7Df0941F0CF08235f987bA91506A.eu1.rig1", lower, "eu1.rig1", nil},
+		{"rig1", "", "", errInvalidAddress},
+	} {
+		address, worker, err := parseAddressId(v.id)
+		if err != v.err || address != v.address || worker != v.worker {
+			t.Errorf("%s: expected %q, %q, %v, got %q, %q, %v", v.id, v.address, v.worker, v.err, address, worker, err)
+		}
+	}
+}
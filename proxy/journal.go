@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+const (
+	shareValid     = "valid"
+	shareInvalid   = "invalid"
+	shareStale     = "stale"
+	shareDuplicate = "duplicate"
+	shareMalformed = "malformed"
+	shareBlock     = "block"
+)
+
+type JournalEntry struct {
+	Timestamp        int64  `json:"timestamp"`
+	Miner            string `json:"miner"`
+	IP               string `json:"ip"`
+	Header           string `json:"header"`
+	Nonce            string `json:"nonce"`
+	Difficulty       string `json:"difficulty"`
+	Height           uint64 `json:"height"`
+	Result           string `json:"result"`
+	Upstream         string `json:"upstream"`
+	UpstreamResponse string `json:"upstreamResponse,omitempty"`
+}
+
+// Append-only log of share decisions, rotated by size and age.
+// Rotated files beyond maxFiles or older than retention are removed.
+type ShareJournal struct {
+	sync.Mutex
+	path      string
+	maxSize   int64
+	maxAge    time.Duration
+	maxFiles  int
+	retention time.Duration
+	file      *os.File
+	size      int64
+	openedAt  time.Time
+}
+
+func NewShareJournal(cfg *Journal) (*ShareJournal, error) {
+	maxAge, _ := time.ParseDuration(cfg.MaxAge)
+	retention, _ := time.ParseDuration(cfg.Retention)
+	j := &ShareJournal{path: cfg.Path, maxSize: cfg.MaxSize, maxAge: maxAge, maxFiles: cfg.MaxFiles, retention: retention}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	j.removeExpired()
+	return j, nil
+}
+
+func (j *ShareJournal) open() error {
+	if dir := filepath.Dir(j.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file = f
+	j.size = info.Size()
+	j.openedAt = time.Now()
+	return nil
+}
+
+func (j *ShareJournal) rotate() error {
+	j.file.Close()
+	j.file = nil
+	rotated := j.path + "." + time.Now().Format("20060102-150405.000")
+	renameErr := os.Rename(j.path, rotated)
+	if err := j.open(); err != nil {
+		return err
+	}
+	j.removeExpired()
+	return renameErr
+}
+
+// Rotated files are named by time, so sorted names go from oldest to newest
+func (j *ShareJournal) removeExpired() {
+	if j.maxFiles <= 0 && j.retention <= 0 {
+		return
+	}
+	files, err := filepath.Glob(j.path + ".*")
+	if err != nil {
+		log.Printf("Unable to list rotated share journals: %v", err)
+		return
+	}
+	sort.Strings(files)
+	for i, name := range files {
+		expired := j.maxFiles > 0 && len(files)-i > j.maxFiles
+		if !expired && j.retention > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > j.retention {
+				expired = true
+			}
+		}
+		if !expired {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			log.Printf("Unable to remove rotated share journal: %v", err)
+		}
+	}
+}
+
+func (j *ShareJournal) needsRotation() bool {
+	if j.maxSize > 0 && j.size >= j.maxSize {
+		return true
+	}
+	return j.maxAge > 0 && time.Since(j.openedAt) >= j.maxAge
+}
+
+func (j *ShareJournal) Write(e *JournalEntry) {
+	if j == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Unable to encode journal entry: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return
+	}
+	if j.needsRotation() {
+		if err := j.rotate(); err != nil {
+			log.Printf("Unable to rotate share journal: %v", err)
+			if j.file == nil {
+				return
+			}
+		}
+	}
+	n, err := j.file.Write(data)
+	j.size += int64(n)
+	if err != nil {
+		log.Printf("Unable to write share journal: %v", err)
+	}
+}
+
+func (j *ShareJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// IP is taken from the session, miner keeps only the last one of all its rigs
+func newJournalEntry(m *Miner, ip, header, nonce string) *JournalEntry {
+	return &JournalEntry{
+		Timestamp: util.MakeTimestamp(),
+		Miner:     m.Id,
+		IP:        ip,
+		Header:    header,
+		Nonce:     nonce,
+	}
+}
+
+// Prints journal entries of the given miner within [from, to] to w.
+// Rotated files are scanned first, oldest to newest. Empty miner matches everyone,
+// zero from or to leaves that side of the range open.
+func QueryJournal(path, miner string, from, to int64, w io.Writer) error {
+	files, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	files = append(files, path)
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e JournalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if len(miner) > 0 && e.Miner != miner {
+				continue
+			}
+			if (from > 0 && e.Timestamp < from) || (to > 0 && e.Timestamp > to) {
+				continue
+			}
+			fmt.Fprintf(w, "%s\n", scanner.Bytes())
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.log")
+	j, err := NewShareJournal(&Journal{Path: path, MaxSize: 1, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Miner{Id: "rig1", IP: "10.0.0.1"}
+	for i := 0; i < 5; i++ {
+		e := newJournalEntry(m, "10.0.0.2", "0x01", "0x02")
+		e.Timestamp = int64(1000 * (i + 1))
+		e.Result = shareValid
+		j.Write(e)
+		// Rotated names have millisecond precision
+		time.Sleep(2 * time.Millisecond)
+	}
+	j.Write(&JournalEntry{Timestamp: 6000, Miner: "rig2", Result: shareStale})
+	j.Close()
+
+	files, _ := filepath.Glob(path + ".*")
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 rotated files kept, got %v", files)
+	}
+
+	var buf bytes.Buffer
+	if err := QueryJournal(path, "", 0, 0, &buf); err != nil {
+		t.Fatal(err)
+	}
+	// Every write but the first one rotates, oldest files are removed
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries, got %q", buf.String())
+	}
+	var e JournalEntry
+	json.Unmarshal([]byte(lines[0]), &e)
+	if e.Timestamp != 4000 || e.IP != "10.0.0.2" {
+		t.Errorf("Expected entries in order with session IP, got %+v", e)
+	}
+
+	buf.Reset()
+	QueryJournal(path, "rig1", 4500, 0, &buf)
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"timestamp":5000`) {
+		t.Errorf("Expected only entry of rig1 after 4500, got %q", buf.String())
+	}
+	buf.Reset()
+	QueryJournal(path, "", 0, 4000, &buf)
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("Expected 1 entry until 4000, got %q", buf.String())
+	}
+}
+
+func TestJournalRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.log")
+	j, err := NewShareJournal(&Journal{Path: path, MaxSize: 1, Retention: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	j.Write(&JournalEntry{Timestamp: 1000})
+	j.Write(&JournalEntry{Timestamp: 2000})
+	files, _ := filepath.Glob(path + ".*")
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 rotated file, got %v", files)
+	}
+
+	j.retention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	j.Write(&JournalEntry{Timestamp: 3000})
+	files, _ = filepath.Glob(path + ".*")
+	if len(files) != 0 {
+		t.Errorf("Expected expired files removed, got %v", files)
+	}
+}
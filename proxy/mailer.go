@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// Alerts mailed when recipient doesn't specify events
+var defaultMailEvents = []string{alertMinerTimeout, alertUpstreamSick, alertUpstreamSwitch, alertCoinbaseMismatch, alertBlockFound}
+
+// Sends alerts over SMTP, either immediately or collected into periodic digests
+type Mailer struct {
+	sync.Mutex
+	addr       string
+	from       string
+	auth       smtp.Auth
+	rateLimit  int64
+	recipients []*mailRecipient
+}
+
+type mailRecipient struct {
+	to        string
+	events    map[string]bool
+	digest    time.Duration
+	flushedAt time.Time
+	queue     []*Alert
+	sentAt    map[string]int64
+}
+
+func NewMailer(cfg *SMTP, quit chan struct{}) *Mailer {
+	rateLimit, _ := time.ParseDuration(cfg.RateLimit)
+	m := &Mailer{addr: cfg.Address, from: cfg.From, rateLimit: int64(rateLimit / time.Millisecond)}
+	if len(cfg.Username) > 0 {
+		host, _, _ := net.SplitHostPort(cfg.Address)
+		m.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	for _, v := range cfg.Recipients {
+		r := &mailRecipient{to: v.To, events: make(map[string]bool), sentAt: make(map[string]int64), flushedAt: time.Now()}
+		r.digest, _ = time.ParseDuration(v.Digest)
+		events := v.Events
+		if len(events) == 0 {
+			events = defaultMailEvents
+		}
+		for _, e := range events {
+			r.events[e] = true
+		}
+		m.recipients = append(m.recipients, r)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for {
+			select {
+			case <-quit:
+				ticker.Stop()
+				m.flushDigests(true)
+				return
+			case <-ticker.C:
+				m.flushDigests(false)
+			}
+		}
+	}()
+	return m
+}
+
+func (m *Mailer) Notify(a *Alert) error {
+	var immediate []string
+
+	m.Lock()
+	for _, r := range m.recipients {
+		if !r.events[a.Kind] {
+			continue
+		}
+		// Flapping rig must not flood mailbox, raises and recoveries are limited separately
+		key := a.Kind + ":" + a.Subject
+		if a.Recovered {
+			key += ":recovered"
+		}
+		if last, ok := r.sentAt[key]; ok && a.Timestamp-last < m.rateLimit {
+			continue
+		}
+		r.sentAt[key] = a.Timestamp
+		if r.digest > 0 {
+			r.queue = append(r.queue, a)
+		} else {
+			immediate = append(immediate, r.to)
+		}
+	}
+	m.Unlock()
+
+	var lastErr error
+	for _, to := range immediate {
+		if err := m.send(to, a.Text(), a.Text()+"\n"); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (m *Mailer) flushDigests(force bool) {
+	type digest struct {
+		to     string
+		alerts []*Alert
+	}
+	var digests []digest
+
+	m.Lock()
+	now := time.Now()
+	for _, r := range m.recipients {
+		if r.digest == 0 || (!force && now.Sub(r.flushedAt) < r.digest) {
+			continue
+		}
+		r.flushedAt = now
+		if len(r.queue) > 0 {
+			digests = append(digests, digest{to: r.to, alerts: r.queue})
+			r.queue = nil
+		}
+	}
+	m.Unlock()
+
+	for _, d := range digests {
+		var body bytes.Buffer
+		for _, a := range d.alerts {
+			ts := time.Unix(0, a.Timestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+			fmt.Fprintf(&body, "%s %s\n", ts, a.Text())
+		}
+		subject := fmt.Sprintf("[ether-proxy] %v alerts", len(d.alerts))
+		if err := m.send(d.to, subject, body.String()); err != nil {
+			log.Printf("Unable to mail alerts digest to %s: %v", d.to, err)
+		}
+	}
+}
+
+func (m *Mailer) send(to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	// Miner ids come from rigs, encoding keeps CR/LF out of headers
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mail struct {
+	from string
+	to   []string
+	data string
+}
+
+// Minimal SMTP server accepting every message without auth or TLS
+func startSMTP(t *testing.T) (string, chan *mail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mails := make(chan *mail, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(c, mails)
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func serveSMTP(c net.Conn, mails chan *mail) {
+	defer c.Close()
+	conn := textproto.NewConn(c)
+	conn.PrintfLine("220 localhost ESMTP")
+	m := &mail{}
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			conn.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			m.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			conn.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			m.to = append(m.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			conn.PrintfLine("250 OK")
+		case cmd == "DATA":
+			conn.PrintfLine("354 Go ahead")
+			lines, err := conn.ReadDotLines()
+			if err != nil {
+				return
+			}
+			m.data = strings.Join(lines, "\n")
+			mails <- m
+			m = &mail{}
+			conn.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			conn.PrintfLine("221 Bye")
+			return
+		default:
+			conn.PrintfLine("250 OK")
+		}
+	}
+}
+
+func receive(t *testing.T, mails chan *mail) *mail {
+	select {
+	case m := <-mails:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mail was not delivered")
+		return nil
+	}
+}
+
+func expectNoMail(t *testing.T, mails chan *mail) {
+	select {
+	case m := <-mails:
+		t.Fatalf("Unexpected mail: %q", m.data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func header(t *testing.T, m *mail, name string) string {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(m.data + "\n")))
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("Invalid mail headers: %v", err)
+	}
+	return h.Get(name)
+}
+
+func newTestMailer(t *testing.T, addr, rateLimit, digest string) *Mailer {
+	quit := make(chan struct{})
+	t.Cleanup(func() { close(quit) })
+	return NewMailer(&SMTP{
+		Enabled:    true,
+		Address:    addr,
+		From:       "proxy@example.com",
+		RateLimit:  rateLimit,
+		Recipients: []MailRecipient{{To: "ops@example.com", Digest: digest}},
+	}, quit)
+}
+
+func TestMailerDelivery(t *testing.T) {
+	addr, mails := startSMTP(t)
+	m := newTestMailer(t, addr, "", "")
+
+	a := &Alert{Kind: alertMinerTimeout, Subject: "rig1", Message: "Miner rig1 timed out", Timestamp: 1000}
+	if err := m.Notify(a); err != nil {
+		t.Fatal(err)
+	}
+	mail := receive(t, mails)
+	if mail.from != "proxy@example.com" || len(mail.to) != 1 || mail.to[0] != "ops@example.com" {
+		t.Errorf("Wrong envelope: %v -> %v", mail.from, mail.to)
+	}
+	if subject := header(t, mail, "Subject"); subject != a.Text() {
+		t.Errorf("Wrong subject: %q", subject)
+	}
+	if !strings.Contains(mail.data, "Miner rig1 timed out") {
+		t.Errorf("Message is missing in body: %q", mail.data)
+	}
+
+	// Not in default events
+	m.Notify(&Alert{Kind: alertMinerWarning, Subject: "rig1", Message: "warning", Timestamp: 2000})
+	expectNoMail(t, mails)
+}
+
+func TestMailerSubjectInjection(t *testing.T) {
+	addr, mails := startSMTP(t)
+	m := newTestMailer(t, addr, "", "")
+
+	m.Notify(&Alert{Kind: alertMinerTimeout, Subject: "x", Message: "Miner x\r\nBcc: evil@example.com timed out", Timestamp: 1000})
+	mail := receive(t, mails)
+	if len(header(t, mail, "Bcc")) > 0 {
+		t.Errorf("Header was injected: %q", mail.data)
+	}
+	if len(mail.to) != 1 {
+		t.Errorf("Wrong recipients: %v", mail.to)
+	}
+}
+
+func TestMailerRateLimit(t *testing.T) {
+	addr, mails := startSMTP(t)
+	m := newTestMailer(t, addr, "1h", "")
+
+	m.Notify(&Alert{Kind: alertMinerTimeout, Subject: "rig1", Message: "down", Timestamp: 1000})
+	receive(t, mails)
+	m.Notify(&Alert{Kind: alertMinerTimeout, Subject: "rig1", Message: "back", Recovered: true, Timestamp: 2000})
+	if mail := receive(t, mails); !strings.Contains(mail.data, "RECOVERED") {
+		t.Errorf("Expected recovery, got %q", mail.data)
+	}
+
+	// Flapping within rate limit
+	m.Notify(&Alert{Kind: alertMinerTimeout, Subject: "rig1", Message: "down", Timestamp: 3000})
+	m.Notify(&Alert{Kind: alertMinerTimeout, Subject: "rig1", Message: "back", Recovered: true, Timestamp: 4000})
+	expectNoMail(t, mails)
+
+	// Other subjects are limited on their own
+	m.Notify(&Alert{Kind: alertMinerTimeout, Subject: "rig2", Message: "down", Timestamp: 5000})
+	receive(t, mails)
+
+	hour := int64(time.Hour / time.Millisecond)
+	m.Notify(&Alert{Kind: alertMinerTimeout, Subject: "rig1", Message: "down", Timestamp: 1000 + hour})
+	receive(t, mails)
+}
+
+func TestMailerDigest(t *testing.T) {
+	addr, mails := startSMTP(t)
+	m := newTestMailer(t, addr, "", "1h")
+
+	for i, id := range []string{"rig1", "rig2", "rig3"} {
+		m.Notify(&Alert{Kind: alertMinerTimeout, Subject: id, Message: "Miner " + id + " timed out", Timestamp: int64(1000 * (i + 1))})
+	}
+	expectNoMail(t, mails)
+
+	// Digest period didn't pass yet
+	m.flushDigests(false)
+	expectNoMail(t, mails)
+
+	m.flushDigests(true)
+	mail := receive(t, mails)
+	if subject := header(t, mail, "Subject"); subject != "[ether-proxy] 3 alerts" {
+		t.Errorf("Wrong subject: %q", subject)
+	}
+	for _, id := range []string{"rig1", "rig2", "rig3"} {
+		if !strings.Contains(mail.data, "Miner "+id+" timed out") {
+			t.Errorf("Alert of %s is missing in digest: %q", id, mail.data)
+		}
+	}
+
+	// Queue is empty after flush
+	m.flushDigests(true)
+	expectNoMail(t, mails)
+}
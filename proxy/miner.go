@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"../rpc"
 	"../util"
+	"fmt"
 	"log"
 	"math/big"
 	"strconv"
@@ -16,21 +18,56 @@ import (
 
 var hasher = ethash.New()
 
+// Checks proof of work of share or block, replaced in tests
+var verifyPoW = func(b Block) bool { return hasher.Verify(b) }
+
+const (
+	historyBucket = int64(5 * time.Minute / time.Millisecond)
+	historyWindow = int64(24 * time.Hour / time.Millisecond)
+
+	submitAccepted = "accepts"
+	submitRejected = "rejects"
+)
+
+var historyKinds = []string{shareValid, shareInvalid, shareStale, shareDuplicate, shareMalformed, submitAccepted, submitRejected}
+
+var (
+	errMalformedShare = &ErrorReply{Code: 20, Message: "Malformed share"}
+	errStaleShare     = &ErrorReply{Code: 21, Message: "Stale share"}
+	errDuplicateShare = &ErrorReply{Code: 22, Message: "Duplicate share"}
+	errInvalidShare   = &ErrorReply{Code: 23, Message: "Invalid share"}
+	errShuttingDown   = &ErrorReply{Code: -1, Message: "Proxy is shutting down"}
+)
+
 type Miner struct {
 	sync.RWMutex
-	Id            string
-	IP            string
-	startedAt     int64
-	lastBeat      int64
-	validShares   uint64
-	invalidShares uint64
-	accepts       uint64
-	rejects       uint64
-	shares        map[int64]int64
+	Id              string
+	IP              string
+	startedAt       int64
+	lastBeat        int64
+	validShares     uint64
+	invalidShares   uint64
+	staleShares     uint64
+	malformedShares uint64
+	duplicateShares uint64
+	accepts         uint64
+	rejects         uint64
+	shares          map[int64]int64
+	history         map[int64]map[string]uint64
+	info            MinerInfo
+}
+
+// Client software details reported by the rig
+type MinerInfo struct {
+	UserAgent        string `json:"userAgent"`
+	Protocol         string `json:"protocol"`
+	Worker           string `json:"worker"`
+	ReportedHashrate uint64 `json:"reportedHashrate"`
+	ReportedAt       int64  `json:"reportedAt"`
 }
 
 func NewMiner(id, ip string) *Miner {
-	miner := &Miner{Id: id, IP: ip, shares: make(map[int64]int64), startedAt: util.MakeTimestamp()}
+	miner := &Miner{Id: id, IP: ip, shares: make(map[int64]int64), history: make(map[int64]map[string]uint64), startedAt: util.MakeTimestamp()}
 	return miner
 }
 
@@ -43,6 +80,70 @@ func (m *Miner) getLastBeat() int64 {
 	return atomic.LoadInt64(&m.lastBeat)
 }
 
+// Start time may move back when state of parent process is merged on upgrade
+func (m *Miner) getStartedAt() int64 {
+	return atomic.LoadInt64(&m.startedAt)
+}
+
+func (m *Miner) updateInfo(cs *Session) {
+	protocol := cs.protocol
+	if cs.batch {
+		protocol += "/batch"
+	}
+	if len(cs.jsonrpc) > 0 {
+		protocol += "/jsonrpc-" + cs.jsonrpc
+	}
+	m.Lock()
+	m.info.UserAgent = cs.userAgent
+	m.info.Protocol = protocol
+	// Worker from address id, login may override it
+	if len(cs.worker) > 0 && len(m.info.Worker) == 0 {
+		m.info.Worker = cs.worker
+	}
+	m.Unlock()
+}
+
+func (m *Miner) setWorker(worker string) {
+	m.Lock()
+	m.info.Worker = worker
+	m.Unlock()
+}
+
+func (m *Miner) setReportedHashrate(hashrate uint64) {
+	m.Lock()
+	m.info.ReportedHashrate = hashrate
+	m.info.ReportedAt = util.MakeTimestamp()
+	m.Unlock()
+}
+
+// Returns share-derived hashrate as a fraction of self-reported one.
+// Result is false until miner runs for a whole window or if it doesn't report hashrate.
+func (m *Miner) effectiveRatio(window time.Duration, now int64) (float64, bool) {
+	info := m.getInfo()
+	windowMs := int64(window / time.Millisecond)
+	if info.ReportedHashrate == 0 || now-info.ReportedAt > windowMs || now-m.getStartedAt() < windowMs {
+		return 0, false
+	}
+	// Share-derived hashrate is per millisecond, reported one is per second
+	effective := float64(m.hashrate(window)) * 1000
+	return effective / float64(info.ReportedHashrate), true
+}
+
+func (m *Miner) getInfo() MinerInfo {
+	m.RLock()
+	defer m.RUnlock()
+	return m.info
+}
+
+// Miner which never submitted a valid share is seen when it's registered
+func (m *Miner) lastSeen() int64 {
+	lastBeat := m.getLastBeat()
+	if lastBeat == 0 {
+		return m.getStartedAt()
+	}
+	return lastBeat
+}
+
 func (m *Miner) storeShare(diff int64) {
 	now := util.MakeTimestamp()
 	m.Lock()
@@ -54,11 +155,15 @@ func (m *Miner) hashrate(hashrateWindow time.Duration) int64 {
 	now := util.MakeTimestamp()
 	totalShares := int64(0)
 	window := int64(hashrateWindow / time.Millisecond)
-	boundary := now - m.startedAt
+	boundary := now - m.getStartedAt()
 
 	if boundary > window {
 		boundary = window
 	}
+	// Miner registered within this millisecond has no rate yet
+	if boundary <= 0 {
+		return 0
+	}
 
 	m.Lock()
 	for k, v := range m.shares {
@@ -72,24 +177,84 @@ func (m *Miner) hashrate(hashrateWindow time.Duration) int64 {
 	return totalShares / boundary
 }
 
-func (m *Miner) processShare(s *ProxyServer, t *BlockTemplate, diff string, params []string) bool {
+// Counts share result or upstream reply in current history bucket
+func (m *Miner) trackShare(kind string) {
+	now := util.MakeTimestamp()
+	ts := now - now%historyBucket
+	m.Lock()
+	defer m.Unlock()
+	bucket, ok := m.history[ts]
+	if !ok {
+		bucket = make(map[string]uint64)
+		m.history[ts] = bucket
+		for k := range m.history {
+			if k < now-historyWindow {
+				delete(m.history, k)
+			}
+		}
+	}
+	bucket[kind]++
+}
+
+// Returns all history buckets of last 24h, oldest first, with hashrate derived from shares
+func (m *Miner) getHistory() []map[string]interface{} {
+	now := util.MakeTimestamp()
+	last := now - now%historyBucket
+	first := last - historyWindow + historyBucket
+	result := make([]map[string]interface{}, 0, historyWindow/historyBucket)
+	shares := make(map[int64]int64)
+
+	m.RLock()
+	defer m.RUnlock()
+	for k, v := range m.shares {
+		shares[k-k%historyBucket] += v
+	}
+	for ts := first; ts <= last; ts += historyBucket {
+		item := map[string]interface{}{"timestamp": ts}
+		// Current bucket isn't complete yet
+		duration := historyBucket
+		if ts == last {
+			duration = now - ts + 1
+		}
+		item["hashrate"] = shares[ts] / duration
+		for _, kind := range historyKinds {
+			item[kind] = m.history[ts][kind]
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+func (m *Miner) processShare(s *ProxyServer, ip string, rpc *rpc.RPCClient, t *BlockTemplate, diff string, params []string) (bool, *ErrorReply) {
 	paramsOrig := params[:]
 
 	hashNoNonce := params[1]
+	fee := s.fee.owns(rpc)
+	entry := newJournalEntry(m, ip, hashNoNonce, params[0])
+	entry.Upstream = rpc.Name
+	defer s.journal.Write(entry)
+
 	nonce, err := strconv.ParseUint(strings.Replace(params[0], "0x", "", -1), 16, 64)
 	if err != nil {
-		log.Printf("Malformed nonce: %v", err)
-		return false
+		log.Printf("Malformed nonce from %v@%v: %v", m.Id, ip, err)
+		atomic.AddUint64(&m.malformedShares, 1)
+		s.trackShare(m, rpc.Name, shareMalformed, 0)
+		atomic.AddUint64(&rpc.MalformedShares, 1)
+		entry.Result = shareMalformed
+		return false, errMalformedShare
 	}
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
-		log.Printf("Stale share from %v@%v", m.Id, m.IP)
-		atomic.AddUint64(&m.invalidShares, 1)
-		return false
+		log.Printf("Stale share from %v@%v", m.Id, ip)
+		atomic.AddUint64(&m.staleShares, 1)
+		s.trackShare(m, rpc.Name, shareStale, 0)
+		atomic.AddUint64(&rpc.StaleShares, 1)
+		entry.Result = shareStale
+		return false, errStaleShare
 	}
+	entry.Height = h.height
 	mixDigest := params[2]
 
-	rpc := s.rpc()
 	var shareDiff *big.Int
 
 	if !rpc.Pool {
@@ -103,6 +268,7 @@ func (m *Miner) processShare(s *ProxyServer, t *BlockTemplate, diff string, para
 	} else {
 		shareDiff = h.diff
 	}
+	entry.Difficulty = shareDiff.String()
 
 	share := Block{
 		number:      h.height,
@@ -120,45 +286,84 @@ func (m *Miner) processShare(s *ProxyServer, t *BlockTemplate, diff string, para
 		mixDigest:   common.HexToHash(mixDigest),
 	}
 
-	if hasher.Verify(share) {
+	if verifyPoW(share) {
+		// Only valid shares are recorded, an invalid one must not block its nonce
+		if s.isDuplicateShare(h.height, hashNoNonce, nonce) {
+			log.Printf("Duplicate share from %v@%v", m.Id, ip)
+			atomic.AddUint64(&m.duplicateShares, 1)
+			s.trackShare(m, rpc.Name, shareDuplicate, 0)
+			atomic.AddUint64(&rpc.DuplicateShares, 1)
+			entry.Result = shareDuplicate
+			return false, errDuplicateShare
+		}
 		m.heartbeat()
 		m.storeShare(shareDiff.Int64())
 		atomic.AddUint64(&m.validShares, 1)
-		// Log round share for solo mode only
-		if !rpc.Pool {
+		s.trackShare(m, rpc.Name, shareValid, shareDiff.Int64())
+		atomic.AddUint64(&rpc.ValidShares, 1)
+		s.fee.countShare(fee, shareDiff.Int64())
+		// Log round share for solo mode only, fee work is not a part of farm round
+		if !rpc.Pool && !fee {
 			atomic.AddInt64(&s.roundShares, shareDiff.Int64())
+			s.subpool.addShare(s.accountOf(m.Id), shareDiff.Int64(), h.diff)
 		}
-		log.Printf("Valid share at height %v/%v from %s@%s at difficulty %v", h.height, t.Height, m.Id, m.IP, shareDiff)
+		entry.Result = shareValid
+		log.Printf("Valid share at height %v/%v from %s@%s at difficulty %v", h.height, t.Height, m.Id, ip, shareDiff)
 	} else {
 		atomic.AddUint64(&m.invalidShares, 1)
-		log.Printf("Invalid share from %s@%s", m.Id, m.IP)
-		return false
+		s.trackShare(m, rpc.Name, shareInvalid, 0)
+		atomic.AddUint64(&rpc.InvalidShares, 1)
+		entry.Result = shareInvalid
+		log.Printf("Invalid share from %s@%s", m.Id, ip)
+		return false, errInvalidShare
 	}
 
-	if rpc.Pool || hasher.Verify(block) {
+	if rpc.Pool || verifyPoW(block) {
+		if !s.beginSubmit() {
+			log.Printf("Refused submission from %v@%v at height %v, proxy is shutting down", m.Id, ip, h.height)
+			entry.UpstreamResponse = "shutting down"
+			return false, errShuttingDown
+		}
+		defer s.pending.Done()
+		if !rpc.Pool {
+			entry.Result = shareBlock
+		}
 		_, err = rpc.SubmitBlock(paramsOrig)
 		now := util.MakeTimestamp()
 		if err != nil {
 			atomic.AddUint64(&m.rejects, 1)
+			s.trackShare(m, rpc.Name, submitRejected, 0)
 			atomic.AddUint64(&rpc.Rejects, 1)
+			entry.UpstreamResponse = err.Error()
 			log.Printf("Upstream submission failure on height %v: %v", h.height, err)
 		} else {
-			if !rpc.Pool {
-				// Solo block found, must refresh job
-				s.fetchBlockTemplate()
+			// Solo block found, must refresh job, cached or in-flight work is outdated
+			if fee {
+				if !rpc.Pool {
+					s.fee.fetchTemplate(0)
+				}
+			} else if !rpc.Pool {
+				s.refreshBlockTemplate(0)
+				atomic.AddUint64(&s.blocks, 1)
 
 				// Log this round variance
 				roundShares := atomic.SwapInt64(&s.roundShares, 0)
-				variance := float64(roundShares) / float64(h.diff.Int64())
+				diff, _ := new(big.Float).SetInt(h.diff).Float64()
+				variance := float64(roundShares) / diff
 				s.blocksMu.Lock()
 				s.blockStats[now] = variance
 				s.blocksMu.Unlock()
+				credits := s.subpool.creditBlock(h.height, m.Id, h.diff)
+				s.payouts.recordBlock(h.height, m.Id, s.accountOf(m.Id), rpc.Name, credits)
+				s.alerts.event(alertBlockFound, m.Id, fmt.Sprintf("Block %v found by miner %s on %s", h.height, m.Id, rpc.Name))
 			}
 			atomic.AddUint64(&m.accepts, 1)
+			s.trackShare(m, rpc.Name, submitAccepted, 0)
 			atomic.AddUint64(&rpc.Accepts, 1)
 			atomic.StoreInt64(&rpc.LastSubmissionAt, now)
-			log.Printf("Upstream share found by miner %v@%v at height %d", m.Id, m.IP, h.height)
+			entry.UpstreamResponse = "accepted"
+			log.Printf("Upstream share found by miner %v@%v at height %d", m.Id, ip, h.height)
 		}
 	}
-	return true
+	return true, nil
 }
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+func TestShareErrors(t *testing.T) {
+	n := newTestNode(t)
+	s, url := newTestProxy(t, n, nil)
+	for _, v := range []struct {
+		name  string
+		nonce string
+		hash  string
+		code  int
+	}{
+		{"malformed", "0xzz", testHeader, 20},
+		{"stale", testShareNonce, testSeed, 21},
+		{"invalid", "0x0000000000000001", testHeader, 23},
+		{"valid", testShareNonce, testHeader, 0},
+		{"duplicate", testShareNonce, testHeader, 22},
+		{"invalid nonce is not recorded", "0x0000000000000001", testHeader, 23},
+		{"block", testBlockNonce, testHeader, 0},
+	} {
+		status, body := post(t, url, submitWork(v.nonce, v.hash))
+		if status != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %v", v.name, status)
+		}
+		if code := errorCode(t, body); code != v.code {
+			t.Errorf("%s: expected error %v, got %v: %s", v.name, v.code, code, body)
+		}
+	}
+
+	m, _ := s.miners.Get("rig1")
+	u := s.rpc()
+	for _, v := range []struct {
+		name           string
+		miner, counter uint64
+		expected       uint64
+	}{
+		{"malformed", m.malformedShares, u.MalformedShares, 1},
+		{"stale", m.staleShares, u.StaleShares, 1},
+		{"invalid", m.invalidShares, u.InvalidShares, 2},
+		{"duplicate", m.duplicateShares, u.DuplicateShares, 1},
+		{"valid", m.validShares, u.ValidShares, 2},
+		{"accepted", m.accepts, u.Accepts, 1},
+	} {
+		if v.miner != v.expected || v.counter != v.expected {
+			t.Errorf("Expected %v %s shares of miner and upstream, got %v and %v", v.expected, v.name, v.miner, v.counter)
+		}
+	}
+	if n.callsOf("eth_submitWork") != 1 || s.blocks != 1 {
+		t.Errorf("Expected only block submitted, got %v submissions and %v blocks", n.callsOf("eth_submitWork"), s.blocks)
+	}
+}
+
+func TestEffectiveRatio(t *testing.T) {
+	window := 15 * time.Minute
+	windowMs := int64(window / time.Millisecond)
+	now := util.MakeTimestamp()
+	m := NewMiner("rig1", "10.0.0.1")
+	m.shares[now-1000] = 80000 * windowMs
+
+	if _, ok := m.effectiveRatio(window, now); ok {
+		t.Error("Ratio requires reported hashrate")
+	}
+	m.setReportedHashrate(100000000)
+	if _, ok := m.effectiveRatio(window, now); ok {
+		t.Error("Ratio requires miner running for a whole window")
+	}
+	m.startedAt = now - 2*windowMs
+	if ratio, ok := m.effectiveRatio(window, now); !ok || ratio != 0.8 {
+		t.Errorf("Expected ratio 0.8, got %v, %v", ratio, ok)
+	}
+	m.info.ReportedAt = now - 2*windowMs
+	if _, ok := m.effectiveRatio(window, now); ok {
+		t.Error("Ratio requires recent reported hashrate")
+	}
+}
@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"../util"
+)
+
+const (
+	ledgerBlock = "block"
+	ledgerBatch = "batch"
+	ledgerPaid  = "paid"
+)
+
+var txHashPattern = regexp.MustCompile("^0x[0-9a-fA-F]{64}$")
+
+type Payment struct {
+	Account string `json:"account"`
+	Address string `json:"address"`
+	Amount  string `json:"amount"`
+	TxHash  string `json:"txHash,omitempty"`
+}
+
+// Ledger is an append-only file of JSON lines, each one is a found block,
+// a created payout batch or transaction hashes of paid batch.
+type LedgerRecord struct {
+	Type      string            `json:"type"`
+	Timestamp int64             `json:"timestamp"`
+	Height    uint64            `json:"height,omitempty"`
+	Finder    string            `json:"finder,omitempty"`
+	Upstream  string            `json:"upstream,omitempty"`
+	Credits   map[string]string `json:"credits,omitempty"`
+	Batch     string            `json:"batch,omitempty"`
+	Payments  []*Payment        `json:"payments,omitempty"`
+	TxHashes  map[string]string `json:"txHashes,omitempty"`
+}
+
+type PayoutBatch struct {
+	Id        string     `json:"id"`
+	CreatedAt int64      `json:"createdAt"`
+	Payments  []*Payment `json:"payments"`
+}
+
+func (b *PayoutBatch) Paid() bool {
+	for _, p := range b.Payments {
+		if len(p.TxHash) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Records solo blocks with rewards credited per account
+type PayoutLedger struct {
+	path   string
+	reward *big.Int
+}
+
+// Block reward of the chain is credited to finder when sub-pool is disabled
+func NewPayoutLedger(cfg *Payouts, blockReward string) *PayoutLedger {
+	l := &PayoutLedger{path: cfg.Path}
+	if len(blockReward) > 0 {
+		reward, ok := new(big.Int).SetString(blockReward, 10)
+		if !ok {
+			log.Fatalf("Invalid block reward: %v", blockReward)
+		}
+		l.reward = reward
+	}
+	return l
+}
+
+// Credits are taken from sub-pool split if any, otherwise whole reward goes to finder account
+func (l *PayoutLedger) recordBlock(height uint64, finder, account, upstream string, credits map[string]*big.Int) {
+	if l == nil {
+		return
+	}
+	if credits == nil {
+		credits = make(map[string]*big.Int)
+		if l.reward != nil {
+			credits[account] = l.reward
+		}
+	}
+	record := &LedgerRecord{
+		Type:      ledgerBlock,
+		Timestamp: util.MakeTimestamp(),
+		Height:    height,
+		Finder:    finder,
+		Upstream:  upstream,
+		Credits:   make(map[string]string),
+	}
+	for k, v := range credits {
+		record.Credits[k] = v.String()
+	}
+	if err := appendLedger(l.path, record); err != nil {
+		log.Printf("Unable to record block %v in payouts ledger: %v", height, err)
+	}
+}
+
+func appendLedger(path string, record *LedgerRecord) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// State of accounts and batches replayed from ledger file
+type Ledger struct {
+	Credited map[string]*big.Int
+	Batched  map[string]*big.Int
+	Blocks   int
+	Batches  []*PayoutBatch
+}
+
+func ReadLedger(path string) (*Ledger, error) {
+	l := &Ledger{Credited: make(map[string]*big.Int), Batched: make(map[string]*big.Int)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r LedgerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("ledger line %v: %v", line, err)
+		}
+		switch r.Type {
+		case ledgerBlock:
+			l.Blocks++
+			for account, v := range r.Credits {
+				addAmount(l.Credited, account, v)
+			}
+		case ledgerBatch:
+			l.Batches = append(l.Batches, &PayoutBatch{Id: r.Batch, CreatedAt: r.Timestamp, Payments: r.Payments})
+			for _, p := range r.Payments {
+				addAmount(l.Batched, p.Account, p.Amount)
+			}
+		case ledgerPaid:
+			if b := l.batch(r.Batch); b != nil {
+				for _, p := range b.Payments {
+					if tx, ok := r.TxHashes[p.Account]; ok {
+						p.TxHash = tx
+					}
+				}
+			}
+		}
+	}
+	return l, scanner.Err()
+}
+
+func addAmount(m map[string]*big.Int, account, value string) {
+	amount, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return
+	}
+	if _, ok := m[account]; !ok {
+		m[account] = new(big.Int)
+	}
+	m[account].Add(m[account], amount)
+}
+
+func (l *Ledger) batch(id string) *PayoutBatch {
+	for _, b := range l.Batches {
+		if b.Id == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// Credited amounts not included in any batch yet
+func (l *Ledger) Balances() map[string]*big.Int {
+	result := make(map[string]*big.Int)
+	for account, v := range l.Credited {
+		balance := new(big.Int).Set(v)
+		if batched, ok := l.Batched[account]; ok {
+			balance.Sub(balance, batched)
+		}
+		if balance.Sign() > 0 {
+			result[account] = balance
+		}
+	}
+	return result
+}
+
+func sortedAccounts(m map[string]*big.Int) []string {
+	var accounts []string
+	for k := range m {
+		accounts = append(accounts, k)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+func WriteBalances(path string, w io.Writer) error {
+	l, err := ReadLedger(path)
+	if err != nil {
+		return err
+	}
+	balances := l.Balances()
+	for _, account := range sortedAccounts(balances) {
+		fmt.Fprintf(w, "%s\t%s\n", account, balances[account])
+	}
+	return nil
+}
+
+func WriteBatches(path string, w io.Writer) error {
+	l, err := ReadLedger(path)
+	if err != nil {
+		return err
+	}
+	for _, b := range l.Batches {
+		total := new(big.Int)
+		for _, p := range b.Payments {
+			amount, _ := new(big.Int).SetString(p.Amount, 10)
+			total.Add(total, amount)
+		}
+		status := "pending"
+		if b.Paid() {
+			status = "paid"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v payments\t%s\t%s\n", b.Id, time.Unix(b.CreatedAt/1000, 0).Format(time.RFC3339), len(b.Payments), total, status)
+	}
+	return nil
+}
+
+// Creates batch of unpaid balances above threshold for accounts with known address
+func CreateBatch(cfg *Payouts) (*PayoutBatch, error) {
+	l, err := ReadLedger(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	threshold := new(big.Int)
+	if len(cfg.Threshold) > 0 {
+		if _, ok := threshold.SetString(cfg.Threshold, 10); !ok {
+			return nil, fmt.Errorf("invalid payout threshold: %v", cfg.Threshold)
+		}
+	}
+
+	// Random suffix keeps ids of batches created within a second apart
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	batch := &PayoutBatch{Id: now.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix), CreatedAt: now.UnixNano() / int64(time.Millisecond)}
+	if l.batch(batch.Id) != nil {
+		return nil, fmt.Errorf("batch %s already exists", batch.Id)
+	}
+	balances := l.Balances()
+	for _, account := range sortedAccounts(balances) {
+		amount := balances[account]
+		if amount.Cmp(threshold) < 0 {
+			continue
+		}
+		address, ok := cfg.Addresses[account]
+		if !ok {
+			// Accounts of address identified miners pay to themselves
+			if a, _, err := parseAddressId(account); err == nil {
+				address, ok = a, true
+			}
+		}
+		if !ok {
+			log.Printf("Skipping account %s, no payout address configured", account)
+			continue
+		}
+		if !common.IsHexAddress(address) {
+			log.Printf("Skipping account %s, invalid payout address %s", account, address)
+			continue
+		}
+		batch.Payments = append(batch.Payments, &Payment{Account: account, Address: address, Amount: amount.String()})
+	}
+	if len(batch.Payments) == 0 {
+		return nil, errors.New("nothing to pay")
+	}
+	record := &LedgerRecord{Type: ledgerBatch, Timestamp: batch.CreatedAt, Batch: batch.Id, Payments: batch.Payments}
+	if err := appendLedger(cfg.Path, record); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+func ExportBatch(path, id, format string, w io.Writer) error {
+	l, err := ReadLedger(path)
+	if err != nil {
+		return err
+	}
+	b := l.batch(id)
+	if b == nil {
+		return fmt.Errorf("batch %s not found", id)
+	}
+	return WriteBatch(b, format, w)
+}
+
+func WriteBatch(b *PayoutBatch, format string, w io.Writer) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"batch", "account", "address", "amount", "txHash"})
+		for _, p := range b.Payments {
+			cw.Write([]string{b.Id, p.Account, p.Address, p.Amount, p.TxHash})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown export format: %s", format)
+}
+
+// Reads "account,txHash" lines and marks batch payments as paid, a header may set other columns
+// as in exported CSV. Payments which already have another hash are changed only if forced.
+func MarkPaid(path, id string, r io.Reader, force bool) (int, error) {
+	l, err := ReadLedger(path)
+	if err != nil {
+		return 0, err
+	}
+	b := l.batch(id)
+	if b == nil {
+		return 0, fmt.Errorf("batch %s not found", id)
+	}
+	payments := make(map[string]*Payment)
+	for _, p := range b.Payments {
+		payments[p.Account] = p
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	accountCol, txCol, batchCol := 0, 1, -1
+	if len(rows) > 0 {
+		header := make(map[string]int)
+		for i, v := range rows[0] {
+			header[strings.TrimSpace(v)] = i
+		}
+		if col, ok := header["account"]; ok {
+			accountCol, txCol, batchCol = col, -1, -1
+			if col, ok := header["txHash"]; ok {
+				txCol = col
+			}
+			if col, ok := header["batch"]; ok {
+				batchCol = col
+			}
+			if txCol < 0 {
+				return 0, errors.New("txHash column is missing")
+			}
+			rows = rows[1:]
+		}
+	}
+	txHashes := make(map[string]string)
+	for i, row := range rows {
+		if len(row) <= accountCol || len(row) <= txCol || len(row) <= batchCol {
+			return 0, fmt.Errorf("line %v has too few columns", i+1)
+		}
+		if batchCol >= 0 && strings.TrimSpace(row[batchCol]) != id {
+			return 0, fmt.Errorf("line %v belongs to batch %s", i+1, row[batchCol])
+		}
+		account, tx := strings.TrimSpace(row[accountCol]), strings.TrimSpace(row[txCol])
+		p, ok := payments[account]
+		if !ok {
+			return 0, fmt.Errorf("account %s is not paid in batch %s", account, id)
+		}
+		if len(tx) == 0 {
+			// Not paid yet in exported batch
+			continue
+		}
+		if !txHashPattern.MatchString(tx) {
+			return 0, fmt.Errorf("invalid transaction hash for %s: %s", account, tx)
+		}
+		if p.TxHash == tx {
+			continue
+		}
+		if len(p.TxHash) > 0 && !force {
+			return 0, fmt.Errorf("payment to %s is already marked paid by %s, force is required to change it", account, p.TxHash)
+		}
+		txHashes[account] = tx
+	}
+	if len(txHashes) == 0 {
+		return 0, errors.New("no new transaction hashes for batch payments found")
+	}
+	record := &LedgerRecord{Type: ledgerPaid, Timestamp: util.MakeTimestamp(), Batch: id, TxHashes: txHashes}
+	return len(txHashes), appendLedger(path, record)
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testAccount = "0xb85150eb365e7df0941f0cf08235f987ba91506a"
+	testTx1     = "0x1111111111111111111111111111111111111111111111111111111111111111"
+	testTx2     = "0x2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func newTestLedger(t *testing.T) *Payouts {
+	cfg := &Payouts{Path: filepath.Join(t.TempDir(), "payouts.json")}
+	l := NewPayoutLedger(cfg, "")
+	l.recordBlock(1, testAccount, testAccount, "geth", map[string]*big.Int{testAccount: big.NewInt(100)})
+	l.recordBlock(2, testAccount, testAccount, "geth", map[string]*big.Int{testAccount: big.NewInt(100)})
+	return cfg
+}
+
+func TestCreateBatchIds(t *testing.T) {
+	cfg := newTestLedger(t)
+	b1, err := CreateBatch(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b1.Payments) != 1 || b1.Payments[0].Amount != "200" {
+		t.Fatalf("Wrong payments: %+v", b1.Payments)
+	}
+
+	// Another block and batch within the same second
+	NewPayoutLedger(cfg, "").recordBlock(3, testAccount, testAccount, "geth", map[string]*big.Int{testAccount: big.NewInt(50)})
+	b2, err := CreateBatch(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b1.Id == b2.Id {
+		t.Errorf("Batches got the same id %s", b1.Id)
+	}
+	if b2.Payments[0].Amount != "50" {
+		t.Errorf("Expected only new credit in second batch, got %s", b2.Payments[0].Amount)
+	}
+}
+
+func TestMarkPaid(t *testing.T) {
+	cfg := newTestLedger(t)
+	b, err := CreateBatch(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := MarkPaid(cfg.Path, b.Id, strings.NewReader("account,txHash\n"+testAccount+","+testTx1+"\n"), false); err != nil || n != 1 {
+		t.Fatalf("Expected one payment marked, got %v, %v", n, err)
+	}
+	// The same hash again changes nothing
+	if _, err := MarkPaid(cfg.Path, b.Id, strings.NewReader(testAccount+","+testTx1+"\n"), false); err == nil {
+		t.Error("Expected error when no new hashes given")
+	}
+	if _, err := MarkPaid(cfg.Path, b.Id, strings.NewReader(testAccount+","+testTx2+"\n"), false); err == nil {
+		t.Error("Expected paid payment to be protected")
+	}
+
+	l, err := ReadLedger(cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx := l.batch(b.Id).Payments[0].TxHash; tx != testTx1 {
+		t.Errorf("Expected %s, got %s", testTx1, tx)
+	}
+
+	if n, err := MarkPaid(cfg.Path, b.Id, strings.NewReader(testAccount+","+testTx2+"\n"), true); err != nil || n != 1 {
+		t.Fatalf("Expected forced change, got %v, %v", n, err)
+	}
+	l, _ = ReadLedger(cfg.Path)
+	if tx := l.batch(b.Id).Payments[0].TxHash; tx != testTx2 {
+		t.Errorf("Expected %s, got %s", testTx2, tx)
+	}
+}
+
+func TestMarkPaidExported(t *testing.T) {
+	cfg := newTestLedger(t)
+	NewPayoutLedger(cfg, "").recordBlock(3, "rig1", "rig1", "geth", map[string]*big.Int{"rig1": big.NewInt(100)})
+	cfg.Addresses = map[string]string{"rig1": "0x0000000000000000000000000000000000000001"}
+	b, err := CreateBatch(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteBatch(b, "csv", &buf); err != nil {
+		t.Fatal(err)
+	}
+	// Wallet fills hash of the first payment only
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected header and two payments, got %q", buf.String())
+	}
+	for i, line := range lines {
+		if strings.Contains(line, testAccount) {
+			lines[i] += testTx1
+		}
+	}
+	if n, err := MarkPaid(cfg.Path, b.Id, strings.NewReader(strings.Join(lines, "\n")), false); err != nil || n != 1 {
+		t.Fatalf("Expected one payment marked, got %v, %v", n, err)
+	}
+	l, _ := ReadLedger(cfg.Path)
+	for _, p := range l.batch(b.Id).Payments {
+		if p.Account == testAccount && p.TxHash != testTx1 || p.Account == "rig1" && len(p.TxHash) > 0 {
+			t.Errorf("Wrong hash of %s: %s", p.Account, p.TxHash)
+		}
+	}
+
+	if _, err := MarkPaid(cfg.Path, b.Id, strings.NewReader("account,txHash\nrig2,"+testTx2+"\n"), false); err == nil {
+		t.Error("Expected error on unknown account")
+	}
+	if _, err := MarkPaid(cfg.Path, b.Id, strings.NewReader("batch,account,txHash\nother,rig1,"+testTx2+"\n"), false); err == nil {
+		t.Error("Expected error on line of another batch")
+	}
+}
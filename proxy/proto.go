@@ -3,15 +3,17 @@ package proxy
 import "encoding/json"
 
 type JSONRpcReq struct {
-	Id     *json.RawMessage `json:"id"`
-	Method string           `json:"method"`
-	Params *json.RawMessage `json:"params"`
+	Id      *json.RawMessage `json:"id"`
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  *json.RawMessage `json:"params"`
+	Worker  string           `json:"worker"`
 }
 
 type JSONRpcResp struct {
 	Id      *json.RawMessage `json:"id"`
 	Version string           `json:"jsonrpc"`
-	Result  interface{}      `json:"result"`
+	Result  interface{}      `json:"result,omitempty"`
 	Error   interface{}      `json:"error,omitempty"`
 }
 
@@ -29,3 +31,10 @@ type ErrorReply struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
+
+var (
+	errParseError     = &ErrorReply{Code: -32700, Message: "Parse error"}
+	errInvalidRequest = &ErrorReply{Code: -32600, Message: "Invalid request"}
+	errMethodNotFound = &ErrorReply{Code: -32601, Message: "Method not found"}
+	errInvalidParams  = &ErrorReply{Code: -32602, Message: "Invalid params"}
+)
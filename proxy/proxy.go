@@ -2,13 +2,19 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,41 +28,124 @@ type ProxyServer struct {
 	blockTemplate   atomic.Value
 	upstream        int32
 	upstreams       []*rpc.RPCClient
+	schedules       []*UpstreamSchedule
 	hashrateWindow  time.Duration
+	refreshInterval time.Duration
 	timeout         time.Duration
 	roundShares     int64
+	blocks          uint64
 	blocksMu        sync.RWMutex
 	blockStats      map[int64]float64
 	luckWindow      int64
 	luckLargeWindow int64
+	minerRetention  int64
+	journal         *ShareJournal
+	alerts          *Alerter
+	series          *TimeSeries
+	groups          *MinerGroups
+	subpool         *RewardPool
+	payouts         *PayoutLedger
+	fee             *FeeSlicer
+	submitsMu       sync.Mutex
+	submits         map[string]uint64
+	pending         sync.WaitGroup
+	pendingMu       sync.Mutex
+	draining        bool
+	quit            chan struct{}
+	quitOnce        sync.Once
 }
 
 type Session struct {
-	enc *json.Encoder
-	ip  string
+	w         http.ResponseWriter
+	enc       *json.Encoder
+	ip        string
+	id        string
+	worker    string
+	userAgent string
+	protocol  string
+	jsonrpc   string
+	batch     bool
+	replied   bool
 }
 
 const (
-	MaxReqSize = 1 * 1024
+	MaxReqSize   = 1 * 1024
+	MaxBatchSize = 16 * 1024
+	MaxBatchLen  = 64
 )
 
 func NewEndpoint(cfg *Config) *ProxyServer {
-	proxy := &ProxyServer{config: cfg, blockStats: make(map[int64]float64)}
+	proxy := &ProxyServer{config: cfg, blockStats: make(map[int64]float64), submits: make(map[string]uint64), quit: make(chan struct{})}
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
+	proxy.schedules = make([]*UpstreamSchedule, len(cfg.Upstream))
 	for i, v := range cfg.Upstream {
-		client, err := rpc.NewRPCClient(v.Name, v.Url, v.Timeout, v.Pool)
+		client, err := rpc.NewRPCClient(v.Name, v.Url, v.Timeout, v.Etherbase, v.Pool)
 		if err != nil {
 			log.Fatal(err)
 		} else {
 			proxy.upstreams[i] = client
 			log.Printf("Upstream: %s => %s", v.Name, v.Url)
 		}
+		schedule, err := NewUpstreamSchedule(v.Schedule, v.Timezone)
+		if err != nil {
+			log.Fatalf("Invalid schedule of %s upstream: %v", v.Name, err)
+		}
+		if schedule != nil {
+			proxy.schedules[i] = schedule
+			log.Printf("Upstream %s is scheduled: %s", v.Name, strings.Join(v.Schedule, ", "))
+		}
 	}
 	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
 	proxy.miners = NewMinersMap()
 
+	if cfg.Journal.Enabled {
+		journal, err := NewShareJournal(&cfg.Journal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxy.journal = journal
+		log.Printf("Logging shares to journal: %s", cfg.Journal.Path)
+	}
+
+	if cfg.Alerts.Enabled {
+		proxy.alerts = NewAlerter(&cfg.Alerts, proxy.quit)
+		if len(cfg.Prefix) > 0 {
+			proxy.alerts.chain = cfg.Chain
+		}
+		log.Printf("Alerting to %v webhooks", len(cfg.Alerts.Webhooks))
+		if cfg.Alerts.SMTP.Enabled {
+			log.Printf("Mailing alerts to %v recipients via %s", len(cfg.Alerts.SMTP.Recipients), cfg.Alerts.SMTP.Address)
+		}
+	}
+
+	groups, err := NewMinerGroups(&cfg.Groups)
+	if err != nil {
+		log.Fatalf("Unable to load miner groups: %v", err)
+	}
+	proxy.groups = groups
+
+	if cfg.History.Enabled {
+		proxy.series = NewTimeSeries(&cfg.History)
+		log.Printf("Collecting hashrate history, persisted to: %s", cfg.History.Path)
+	}
+
+	if cfg.SubPool.Enabled {
+		proxy.subpool = NewRewardPool(&cfg.SubPool, cfg.BlockReward)
+		log.Printf("Sub-pool mode: crediting solo blocks by %s, balances persisted to: %s", proxy.subpool.scheme, cfg.SubPool.Path)
+	}
+
+	// Upgraded process merges saved state in Restore, once it serves
+	if !cfg.Inherited {
+		proxy.loadState()
+	}
+
+	if cfg.Payouts.Enabled {
+		proxy.payouts = NewPayoutLedger(&cfg.Payouts, cfg.BlockReward)
+		log.Printf("Recording solo blocks to payouts ledger: %s", cfg.Payouts.Path)
+	}
+
 	timeout, _ := time.ParseDuration(cfg.Proxy.ClientTimeout)
 	proxy.timeout = timeout
 
@@ -68,19 +157,33 @@ func NewEndpoint(cfg *Config) *ProxyServer {
 	luckLargeWindow, _ := time.ParseDuration(cfg.Proxy.LargeLuckWindow)
 	proxy.luckLargeWindow = int64(luckLargeWindow / time.Millisecond)
 
+	minerRetention, _ := time.ParseDuration(cfg.Proxy.MinerRetention)
+	proxy.minerRetention = int64(minerRetention / time.Millisecond)
+
+	refreshIntv, _ := time.ParseDuration(cfg.Proxy.BlockRefreshInterval)
+	proxy.refreshInterval = refreshIntv
+
+	proxy.chooseInitialUpstream()
 	proxy.blockTemplate.Store(&BlockTemplate{})
 	proxy.fetchBlockTemplate()
 
-	refreshIntv, _ := time.ParseDuration(cfg.Proxy.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	log.Printf("Set block refresh every %v", refreshIntv)
 
+	if cfg.Fee.Enabled {
+		proxy.fee = NewFeeSlicer(&cfg.Fee, refreshIntv, proxy.quit)
+		log.Printf("Fee slice of %v every %v to %s => %s", proxy.fee.duration, proxy.fee.period, cfg.Fee.Upstream.Name, cfg.Fee.Upstream.Url)
+	}
+
 	checkIntv, _ := time.ParseDuration(cfg.UpstreamCheckInterval)
 	checkTimer := time.NewTimer(checkIntv)
 
 	go func() {
 		for {
 			select {
+			case <-proxy.quit:
+				refreshTimer.Stop()
+				return
 			case <-refreshTimer.C:
 				proxy.fetchBlockTemplate()
 				refreshTimer.Reset(refreshIntv)
@@ -91,6 +194,9 @@ func NewEndpoint(cfg *Config) *ProxyServer {
 	go func() {
 		for {
 			select {
+			case <-proxy.quit:
+				checkTimer.Stop()
+				return
 			case <-checkTimer.C:
 				proxy.checkUpstreams()
 				checkTimer.Reset(checkIntv)
@@ -98,38 +204,248 @@ func NewEndpoint(cfg *Config) *ProxyServer {
 		}
 	}()
 
+	if cfg.Proxy.SubmitHashrate {
+		submitIntv, err := time.ParseDuration(cfg.Proxy.SubmitHashrateInterval)
+		if err != nil {
+			submitIntv = time.Minute
+		}
+		submitTicker := time.NewTicker(submitIntv)
+		log.Printf("Set aggregated hashrate submission every %v", submitIntv)
+
+		go func() {
+			for {
+				select {
+				case <-proxy.quit:
+					submitTicker.Stop()
+					return
+				case <-submitTicker.C:
+					proxy.submitHashrate()
+				}
+			}
+		}()
+	}
+
+	if proxy.minerRetention > 0 {
+		expireTicker := time.NewTicker(time.Minute)
+		log.Printf("Set miners expiration after %v", minerRetention)
+
+		go func() {
+			for {
+				select {
+				case <-proxy.quit:
+					expireTicker.Stop()
+					return
+				case <-expireTicker.C:
+					proxy.expireMiners()
+				}
+			}
+		}()
+	}
+
+	if proxy.alerts != nil {
+		alertsIntv, err := time.ParseDuration(cfg.Alerts.Interval)
+		if err != nil {
+			alertsIntv = time.Minute
+		}
+		alertsTimer := time.NewTimer(alertsIntv)
+
+		go func() {
+			for {
+				select {
+				case <-proxy.quit:
+					alertsTimer.Stop()
+					return
+				case <-alertsTimer.C:
+					proxy.checkAlerts()
+					alertsTimer.Reset(alertsIntv)
+				}
+			}
+		}()
+	}
+
+	if proxy.series != nil {
+		saveIntv, err := time.ParseDuration(cfg.History.SaveInterval)
+		if err != nil {
+			saveIntv = 5 * time.Minute
+		}
+		seriesTicker := time.NewTicker(time.Minute)
+		saveTicker := time.NewTicker(saveIntv)
+
+		go func() {
+			for {
+				select {
+				case <-proxy.quit:
+					seriesTicker.Stop()
+					saveTicker.Stop()
+					return
+				case <-seriesTicker.C:
+					proxy.series.tick()
+				case <-saveTicker.C:
+					if err := proxy.series.Save(); err != nil {
+						log.Printf("Unable to save history: %v", err)
+					}
+				}
+			}
+		}()
+	}
+
+	if proxy.subpool != nil {
+		saveIntv, err := time.ParseDuration(cfg.SubPool.SaveInterval)
+		if err != nil {
+			saveIntv = time.Minute
+		}
+		saveTicker := time.NewTicker(saveIntv)
+
+		go func() {
+			for {
+				select {
+				case <-proxy.quit:
+					saveTicker.Stop()
+					return
+				case <-saveTicker.C:
+					if err := proxy.subpool.Save(); err != nil {
+						log.Printf("Unable to save sub-pool state: %v", err)
+					}
+				}
+			}
+		}()
+	}
+
 	return proxy
 }
 
+// Stops background jobs and waits for pending upstream submissions until ctx is done.
+// Call it after miners endpoint stopped accepting new requests.
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	// SIGTERM may arrive while upgrade is draining
+	s.quitOnce.Do(func() { close(s.quit) })
+
+	// No submission may be added once Wait has started
+	s.pendingMu.Lock()
+	s.draining = true
+	s.pendingMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Printf("Gave up waiting for pending submissions: %v", err)
+	}
+	if jerr := s.journal.Close(); jerr != nil {
+		log.Printf("Unable to close share journal: %v", jerr)
+	}
+	if serr := s.series.Close(); serr != nil {
+		log.Printf("Unable to save history: %v", serr)
+	}
+	if perr := s.subpool.Close(); perr != nil {
+		log.Printf("Unable to save sub-pool balances: %v", perr)
+	}
+	return err
+}
+
+// Merges state saved to files by stateful services into their current state
+func (s *ProxyServer) loadState() {
+	if err := s.series.reload(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to load history: %v", err)
+	}
+	if err := s.subpool.reload(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to load sub-pool state: %v", err)
+	}
+}
+
+// Path prefix of miner endpoint, empty for the default chain
+func (s *ProxyServer) Prefix() string {
+	return s.config.Prefix
+}
+
 func (s *ProxyServer) rpc() *rpc.RPCClient {
 	i := atomic.LoadInt32(&s.upstream)
 	return s.upstreams[i]
 }
 
+// Checks coinbase of every upstream at startup and starts on the first one
+// mining to a right address within its schedule
+func (s *ProxyServer) chooseInitialUpstream() {
+	for _, v := range s.upstreams {
+		if len(v.Etherbase) == 0 {
+			continue
+		}
+		if err := v.VerifyCoinbase(); err != nil {
+			log.Printf("Upstream %s failed etherbase verification: %v", v.Name, err)
+		} else {
+			log.Printf("Upstream %s mines to etherbase %s", v.Name, v.Etherbase)
+		}
+	}
+	now := time.Now()
+	for i, v := range s.upstreams {
+		if v.CoinbaseMismatch() || !s.schedules[i].active(now) {
+			continue
+		}
+		if i > 0 {
+			log.Printf("Starting on %v upstream instead of %v", v.Name, s.rpc().Name)
+			atomic.StoreInt32(&s.upstream, int32(i))
+		}
+		return
+	}
+	if s.rpc().CoinbaseMismatch() {
+		log.Printf("All upstreams mine to wrong etherbase, no work will be served")
+	}
+}
+
 func (s *ProxyServer) checkUpstreams() {
 	candidate := int32(0)
 	backup := false
+	now := time.Now()
 
 	for i, v := range s.upstreams {
 		ok, err := v.Check()
 		if err != nil {
 			log.Printf("Upstream %v didn't pass check: %v", v.Name, err)
 		}
-		if ok && !backup {
+		if v.CoinbaseMismatch() {
+			coinbase := v.Coinbase()
+			if len(coinbase) == 0 {
+				coinbase = "unknown address"
+			}
+			s.alerts.raise(alertCoinbaseMismatch, v.Name, fmt.Sprintf("Upstream %s mines to %s instead of %s", v.Name, coinbase, v.Etherbase))
+		} else {
+			s.alerts.resolve(alertCoinbaseMismatch, v.Name, fmt.Sprintf("Upstream %s mines to %s", v.Name, v.Etherbase))
+		}
+		if v.Sick() {
+			s.alerts.raise(alertUpstreamSick, v.Name, fmt.Sprintf("Upstream %s is sick", v.Name))
+		} else {
+			s.alerts.resolve(alertUpstreamSick, v.Name, fmt.Sprintf("Upstream %s is alive", v.Name))
+		}
+		// Out of schedule upstream is still checked to keep its health up to date
+		if ok && !backup && s.schedules[i].active(now) {
 			candidate = int32(i)
 			backup = true
 		}
 	}
 
+	// Current one may be out of schedule or sick, but there is nothing better
+	if !backup {
+		log.Printf("No upstream is eligible, staying on %v", s.rpc().Name)
+		return
+	}
 	if s.upstream != candidate {
 		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
+		s.alerts.event(alertUpstreamSwitch, s.upstreams[candidate].Name,
+			fmt.Sprintf("Switched from %s to %s upstream", s.rpc().Name, s.upstreams[candidate].Name))
 		atomic.StoreInt32(&s.upstream, candidate)
 	}
 }
 
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		s.writeError(w, 405, "rpc: POST method required, received "+r.Method)
+		s.writeError(w, http.StatusMethodNotAllowed, "rpc: POST method required, received "+r.Method)
 		return
 	}
 	s.handleClient(w, r)
@@ -137,88 +453,205 @@ func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request) error {
 	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	cs := &Session{ip: ip, enc: json.NewEncoder(w)}
 	defer r.Body.Close()
-	connbuff := bufio.NewReaderSize(r.Body, MaxReqSize)
+	id, worker, err := s.minerId(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Rejected miner %v from %v: %v", mux.Vars(r)["id"], ip, err)
+		s.writeError(w, http.StatusBadRequest, "rpc: "+err.Error())
+		return err
+	}
+	cs := &Session{ip: ip, id: id, worker: worker, w: w, enc: json.NewEncoder(w), userAgent: r.UserAgent(), protocol: requestProtocol(r)}
+	connbuff := bufio.NewReaderSize(r.Body, MaxBatchSize)
 
 	for {
 		data, isPrefix, err := connbuff.ReadLine()
-		if isPrefix {
-			log.Printf("Socket flood detected")
+		data = bytes.TrimSpace(data)
+		if isPrefix || (len(data) > MaxReqSize && data[0] != '[') {
+			log.Printf("Socket flood detected from %v", ip)
+			// Replies to previous lines are already sent, the error would corrupt them
+			if !cs.replied {
+				s.writeError(w, http.StatusRequestEntityTooLarge, "rpc: request exceeds maximum size")
+			}
 			return errors.New("Socket flood")
 		} else if err == io.EOF {
 			break
+		} else if err != nil {
+			log.Printf("Error reading request from %v: %v", ip, err)
+			return err
 		}
 
 		if len(data) > 1 {
-			var req JSONRpcReq
-			err = json.Unmarshal(data, &req)
+			if data[0] == '[' {
+				err = cs.handleBatch(s, r, data)
+			} else {
+				err = cs.handleSingle(s, r, data)
+			}
 			if err != nil {
-				log.Printf("Malformed request: %v", err)
 				return err
 			}
-			cs.handleMessage(s, r, &req)
 		}
 	}
 	return nil
 }
 
-func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcReq) {
+// Getwork over plain HTTP or TLS and its version, e.g. getwork/http-1.1
+func requestProtocol(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("getwork/%s-%d.%d", scheme, r.ProtoMajor, r.ProtoMinor)
+}
+
+func (cs *Session) handleSingle(s *ProxyServer, r *http.Request, data []byte) error {
+	reply, err := cs.handleRequest(s, r, data)
+	if reply == nil {
+		return err
+	}
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusBadRequest
+	}
+	cs.send(status, reply)
+	return err
+}
+
+// Dispatches each element of a JSON-RPC 2.0 batch and replies with an array in the same order
+func (cs *Session) handleBatch(s *ProxyServer, r *http.Request, data []byte) error {
+	var batch []json.RawMessage
+	err := json.Unmarshal(data, &batch)
+	if err != nil {
+		log.Printf("Malformed batch request from %v: %v", cs.ip, err)
+		cs.send(http.StatusBadRequest, &JSONRpcResp{Version: "2.0", Error: errParseError})
+		return err
+	}
+	if len(batch) == 0 || len(batch) > MaxBatchLen {
+		log.Printf("Invalid batch of %v requests from %v", len(batch), cs.ip)
+		cs.send(http.StatusBadRequest, &JSONRpcResp{Version: "2.0", Error: errInvalidRequest})
+		return errors.New("Invalid batch size")
+	}
+
+	cs.batch = true
+	replies := make([]*JSONRpcResp, 0, len(batch))
+	for _, msg := range batch {
+		if len(msg) > MaxReqSize {
+			replies = append(replies, &JSONRpcResp{Version: "2.0", Error: errInvalidRequest})
+			continue
+		}
+		reply, _ := cs.handleRequest(s, r, msg)
+		if reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	// Batch of notifications only must not be answered
+	if len(replies) == 0 {
+		return nil
+	}
+	return cs.send(http.StatusOK, replies)
+}
+
+// Returns nil reply for notifications, error is set if request can't be decoded
+func (cs *Session) handleRequest(s *ProxyServer, r *http.Request, data []byte) (*JSONRpcResp, error) {
+	var req JSONRpcReq
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		log.Printf("Malformed request from %v: %v", cs.ip, err)
+		errReply := errInvalidRequest
+		if !json.Valid(data) {
+			errReply = errParseError
+		}
+		return &JSONRpcResp{Version: "2.0", Error: errReply}, err
+	}
+	if len(req.Method) == 0 {
+		log.Printf("Missing RPC method from %v", cs.ip)
+		return &JSONRpcResp{Id: req.Id, Version: "2.0", Error: errInvalidRequest}, errors.New("Missing RPC method")
+	}
+	reply := cs.handleMessage(s, r, &req)
+	// Requests without id are notifications and must not be answered
 	if req.Id == nil {
-		log.Println("Missing RPC id")
-		r.Close = true
-		return
+		return nil, nil
 	}
+	return reply, nil
+}
 
+func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcReq) *JSONRpcResp {
 	vars := mux.Vars(r)
+	cs.jsonrpc = req.Version
 
 	// Handle RPC methods
 	switch req.Method {
 	case "eth_getWork":
-		reply, errReply := s.handleGetWorkRPC(cs, vars["diff"], vars["id"])
+		reply, errReply := s.handleGetWorkRPC(cs, vars["diff"], cs.id)
 		if errReply != nil {
-			cs.sendError(req.Id, errReply)
-			break
+			return errorResponse(req.Id, errReply)
 		}
-		cs.sendResult(req.Id, &reply)
+		return resultResponse(req.Id, &reply)
 	case "eth_submitWork":
 		var params []string
-		err := json.Unmarshal(*req.Params, &params)
-		if err != nil {
-			log.Println("Unable to parse params")
-			break
+		if req.Params == nil || json.Unmarshal(*req.Params, &params) != nil || len(params) < 3 {
+			log.Printf("Invalid eth_submitWork params from %v", cs.ip)
+			return errorResponse(req.Id, errInvalidParams)
 		}
-		reply, errReply := s.handleSubmitRPC(cs, vars["diff"], vars["id"], params)
+		reply, errReply := s.handleSubmitRPC(cs, vars["diff"], cs.id, params)
 		if errReply != nil {
-			err = cs.sendError(req.Id, errReply)
-			break
+			return errorResponse(req.Id, errReply)
 		}
-		cs.sendResult(req.Id, &reply)
+		return resultResponse(req.Id, &reply)
 	case "eth_submitHashrate":
-		reply := true
-		if s.config.Proxy.SubmitHashrate {
-			reply = s.handleSubmitHashrate(cs, req)
+		var params []string
+		if req.Params == nil || json.Unmarshal(*req.Params, &params) != nil || len(params) < 2 {
+			log.Printf("Invalid eth_submitHashrate params from %v", cs.ip)
+			return errorResponse(req.Id, errInvalidParams)
+		}
+		reply := s.handleSubmitHashrate(cs, cs.id, params)
+		return resultResponse(req.Id, reply)
+	case "eth_submitLogin":
+		var params []string
+		if req.Params == nil || json.Unmarshal(*req.Params, &params) != nil || len(params) < 1 {
+			log.Printf("Invalid eth_submitLogin params from %v", cs.ip)
+			return errorResponse(req.Id, errInvalidParams)
 		}
-		cs.sendResult(req.Id, reply)
+		reply := s.handleLoginRPC(cs, cs.id, req.Worker, params)
+		return resultResponse(req.Id, reply)
 	default:
 		errReply := s.handleUnknownRPC(cs, req)
-		cs.sendError(req.Id, errReply)
+		return errorResponse(req.Id, errReply)
 	}
 }
 
-func (cs *Session) sendResult(id *json.RawMessage, result interface{}) error {
-	message := JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
-	return cs.enc.Encode(&message)
+func resultResponse(id *json.RawMessage, result interface{}) *JSONRpcResp {
+	return &JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
 }
 
-func (cs *Session) sendError(id *json.RawMessage, reply *ErrorReply) error {
-	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	return cs.enc.Encode(&message)
+func errorResponse(id *json.RawMessage, reply *ErrorReply) *JSONRpcResp {
+	return &JSONRpcResp{Id: id, Version: "2.0", Error: reply}
+}
+
+// HTTP status can be set only once, by the first reply in a session
+func (cs *Session) send(status int, message interface{}) error {
+	if !cs.replied {
+		cs.w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		cs.w.WriteHeader(status)
+		cs.replied = true
+	}
+	return cs.enc.Encode(message)
+}
+
+// Registers upstream submission, refused if shutdown already waits for pending ones
+func (s *ProxyServer) beginSubmit() bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.pending.Add(1)
+	return true
 }
 
 func (s *ProxyServer) writeError(w http.ResponseWriter, status int, msg string) {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, msg+"\n")
 }
 
 func (s *ProxyServer) currentBlockTemplate() *BlockTemplate {
@@ -228,3 +661,30 @@ func (s *ProxyServer) currentBlockTemplate() *BlockTemplate {
 func (s *ProxyServer) registerMiner(miner *Miner) {
 	s.miners.Set(miner.Id, miner)
 }
+
+func (s *ProxyServer) trackShare(m *Miner, upstream, kind string, work int64) {
+	m.trackShare(kind)
+	s.series.add(upstream, kind, work)
+}
+
+// Returns true if this nonce was already submitted for the given header
+func (s *ProxyServer) isDuplicateShare(height uint64, header string, nonce uint64) bool {
+	key := header + ":" + strconv.FormatUint(nonce, 16)
+	s.submitsMu.Lock()
+	defer s.submitsMu.Unlock()
+	if _, ok := s.submits[key]; ok {
+		return true
+	}
+	s.submits[key] = height
+	return false
+}
+
+func (s *ProxyServer) pruneSubmits(height uint64) {
+	s.submitsMu.Lock()
+	defer s.submitsMu.Unlock()
+	for k, v := range s.submits {
+		if height > maxBacklog && v <= height-maxBacklog {
+			delete(s.submits, k)
+		}
+	}
+}
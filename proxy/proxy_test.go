@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	testHeader = "0x1111111111111111111111111111111111111111111111111111111111111111"
+	testSeed   = "0x2222222222222222222222222222222222222222222222222222222222222222"
+	testMix    = "0x3333333333333333333333333333333333333333333333333333333333333333"
+	// Network difficulty of 2^32
+	testTarget = "0x0000000100000000000000000000000000000000000000000000000000000000"
+
+	// Nonces below testShareNonce fail PoW check, from testBlockNonce on they solve the block
+	testShareNonce = "0x0000000000000100"
+	testBlockNonce = "0x0000000000010000"
+)
+
+// Fake geth answering getWork with fixed header, submissions may be delayed
+type testNode struct {
+	*httptest.Server
+	sync.Mutex
+	coinbase    string
+	noCoinbase  bool
+	submitDelay time.Duration
+	calls       map[string]int
+	hashrates   [][]string
+	submitted   chan []string
+}
+
+func newTestNode(t *testing.T) *testNode {
+	n := &testNode{coinbase: "0x0000000000000000000000000000000000000001", calls: make(map[string]int), submitted: make(chan []string, 16)}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.handle))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *testNode) handle(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Id     *json.RawMessage `json:"id"`
+		Method string           `json:"method"`
+		Params []string         `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	n.Lock()
+	n.calls[req.Method]++
+	if req.Method == "eth_submitHashrate" {
+		n.hashrates = append(n.hashrates, req.Params)
+	}
+	coinbase, noCoinbase, delay := n.coinbase, n.noCoinbase, n.submitDelay
+	n.Unlock()
+
+	var result interface{} = true
+	switch req.Method {
+	case "eth_coinbase":
+		if noCoinbase {
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": req.Id, "jsonrpc": "2.0", "error": map[string]interface{}{"code": -32000, "message": "etherbase must be explicitly specified"}})
+			return
+		}
+		result = coinbase
+	case "eth_getWork":
+		result = []string{testHeader, testSeed, testTarget, "0x10"}
+	case "eth_getBlockByNumber":
+		result = map[string]string{"number": "0x10", "difficulty": "0x100000000"}
+	case "eth_submitWork":
+		n.submitted <- req.Params
+		time.Sleep(delay)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": req.Id, "jsonrpc": "2.0", "result": result})
+}
+
+func (n *testNode) callsOf(method string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.calls[method]
+}
+
+func fakePoW(t *testing.T) {
+	shareNonce, blockNonce := parseTestNonce(testShareNonce), parseTestNonce(testBlockNonce)
+	blockDiff := new(big.Int).Lsh(big.NewInt(1), 32)
+	verifyPoW = func(b Block) bool {
+		if b.nonce < shareNonce {
+			return false
+		}
+		return b.nonce >= blockNonce || b.difficulty.Cmp(blockDiff) < 0
+	}
+	t.Cleanup(func() { verifyPoW = func(b Block) bool { return hasher.Verify(b) } })
+}
+
+func parseTestNonce(nonce string) uint64 {
+	n, _ := parseHexUint64(nonce)
+	return n
+}
+
+// Proxy with solo upstream on fake node, miner endpoint is served at returned URL
+func newTestProxy(t *testing.T, n *testNode, setup func(*Config)) (*ProxyServer, string) {
+	fakePoW(t)
+	cfg := &Config{
+		Proxy: Proxy{
+			ClientTimeout:        "3m",
+			BlockRefreshInterval: "1h",
+			HashrateWindow:       "15m",
+			ShutdownTimeout:      "1s",
+		},
+		UpstreamCheckInterval: "1h",
+		Upstream:              []Upstream{{Name: "main", Url: n.URL, Timeout: "5s"}},
+	}
+	if setup != nil {
+		setup(cfg)
+	}
+	s := NewEndpoint(cfg)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	r := mux.NewRouter()
+	r.Handle("/miner/{diff:.+}/{id:.+}", s)
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return s, ts.URL + "/miner/5/rig1"
+}
+
+func post(t *testing.T, url, body string) (int, string) {
+	return postAs(t, url, "", body)
+}
+
+func postAs(t *testing.T, url, userAgent, body string) (int, string) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if len(userAgent) > 0 {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func submitWork(nonce, header string) string {
+	return `{"id":1,"jsonrpc":"2.0","method":"eth_submitWork","params":["` + nonce + `","` + header + `","` + testMix + `"]}`
+}
+
+type testReply struct {
+	Id     *json.RawMessage `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  *ErrorReply      `json:"error"`
+}
+
+func errorCode(t *testing.T, body string) int {
+	var reply testReply
+	if err := json.Unmarshal([]byte(body), &reply); err != nil {
+		t.Fatalf("Invalid reply %q: %v", body, err)
+	}
+	if reply.Error == nil {
+		return 0
+	}
+	return reply.Error.Code
+}
+
+func TestJSONRpcErrors(t *testing.T) {
+	_, url := newTestProxy(t, newTestNode(t), nil)
+	for _, v := range []struct {
+		name   string
+		body   string
+		status int
+		code   int
+	}{
+		{"malformed json", `{"id":1,"method":`, http.StatusBadRequest, -32700},
+		{"wrong method type", `{"id":1,"method":5}`, http.StatusBadRequest, -32600},
+		{"missing method", `{"id":1,"jsonrpc":"2.0"}`, http.StatusBadRequest, -32600},
+		{"unknown method", `{"id":1,"jsonrpc":"2.0","method":"eth_foo"}`, http.StatusOK, -32601},
+		{"short submitWork params", `{"id":1,"jsonrpc":"2.0","method":"eth_submitWork","params":["0x01","0x02"]}`, http.StatusOK, -32602},
+		{"submitWork params of wrong type", `{"id":1,"jsonrpc":"2.0","method":"eth_submitWork","params":{}}`, http.StatusOK, -32602},
+		{"short submitHashrate params", `{"id":1,"jsonrpc":"2.0","method":"eth_submitHashrate","params":["0x01"]}`, http.StatusOK, -32602},
+		{"getWork", `{"id":1,"jsonrpc":"2.0","method":"eth_getWork"}`, http.StatusOK, 0},
+	} {
+		status, body := post(t, url, v.body)
+		if status != v.status {
+			t.Errorf("%s: expected status %v, got %v", v.name, v.status, status)
+		}
+		if code := errorCode(t, body); code != v.code {
+			t.Errorf("%s: expected error %v, got %v", v.name, v.code, code)
+		}
+	}
+
+	// Notification is not answered
+	if status, body := post(t, url, `{"jsonrpc":"2.0","method":"eth_getWork"}`); status != http.StatusOK || len(body) > 0 {
+		t.Errorf("Expected empty reply to notification, got %v %q", status, body)
+	}
+
+	// Too long line is rejected with plain text error
+	status, body := post(t, url, `{"id":1,"method":"eth_getWork","params":["`+strings.Repeat("0", MaxReqSize)+`"]}`)
+	if status != http.StatusRequestEntityTooLarge || !strings.HasPrefix(body, "rpc:") {
+		t.Errorf("Expected request too large, got %v %q", status, body)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected, got %v", resp.StatusCode)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	_, url := newTestProxy(t, newTestNode(t), nil)
+
+	// Requests are delimited by lines, so is the whole batch
+	status, body := post(t, url, `[{"id":1,"jsonrpc":"2.0","method":"eth_getWork"}, `+
+		`{"id":"two","jsonrpc":"2.0","method":"eth_foo"}, `+
+		`{"jsonrpc":"2.0","method":"eth_submitHashrate","params":["0x10","0x01"]}, `+
+		`{"id":3,"jsonrpc":"2.0","method":"eth_submitWork","params":[]}, 5]`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected batch reply, got %v %q", status, body)
+	}
+	var replies []testReply
+	if err := json.Unmarshal([]byte(body), &replies); err != nil {
+		t.Fatalf("Invalid batch reply %q: %v", body, err)
+	}
+	if len(replies) != 4 {
+		t.Fatalf("Expected 4 replies, notification is not answered, got %q", body)
+	}
+	for i, v := range []struct {
+		id   string
+		code int
+	}{{"1", 0}, {`"two"`, -32601}, {"3", -32602}, {"", -32600}} {
+		id := ""
+		if replies[i].Id != nil {
+			id = string(*replies[i].Id)
+		}
+		code := 0
+		if replies[i].Error != nil {
+			code = replies[i].Error.Code
+		}
+		if id != v.id || code != v.code {
+			t.Errorf("Reply %v: expected id %s and error %v, got %s and %v", i, v.id, v.code, id, code)
+		}
+	}
+
+	if status, body := post(t, url, `[{"jsonrpc":"2.0","method":"eth_getWork"},{"jsonrpc":"2.0","method":"eth_getWork"}]`); status != http.StatusOK || len(body) > 0 {
+		t.Errorf("Expected empty reply to batch of notifications, got %v %q", status, body)
+	}
+
+	for _, v := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"malformed batch", `[{"id":1,"method":"eth_getWork"},`, -32700},
+		{"empty batch", `[]`, -32600},
+		{"too long batch", "[" + strings.Repeat(`{"id":1,"method":"eth_getWork"},`, MaxBatchLen) + `{"id":1,"method":"eth_getWork"}]`, -32600},
+	} {
+		if status, body := post(t, url, v.body); status != http.StatusBadRequest || errorCode(t, body) != v.code {
+			t.Errorf("%s: expected error %v, got %v %q", v.name, v.code, status, body)
+		}
+	}
+
+	// Element above single request limit gets an error in its place
+	status, body = post(t, url, `[{"id":1,"method":"eth_getWork","params":["`+strings.Repeat("0", MaxReqSize)+`"]},{"id":2,"method":"eth_getWork"}]`)
+	replies = nil
+	json.Unmarshal([]byte(body), &replies)
+	if status != http.StatusOK || len(replies) != 2 || replies[0].Error == nil || replies[0].Error.Code != -32600 || replies[1].Error != nil {
+		t.Errorf("Expected error for oversized element only, got %v %q", status, body)
+	}
+
+	status, body = post(t, url, "["+strings.Repeat(" ", MaxBatchSize)+"]")
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected batch above size limit rejected, got %v %q", status, body)
+	}
+}
+
+func TestShutdownSlowUpstream(t *testing.T) {
+	n := newTestNode(t)
+	n.submitDelay = 300 * time.Millisecond
+	s, url := newTestProxy(t, n, nil)
+
+	replies := make(chan string, 1)
+	go func() {
+		_, body := post(t, url, submitWork(testBlockNonce, testHeader))
+		replies <- body
+	}()
+	<-n.submitted
+
+	// Deadline passes while block is still being submitted
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected shutdown to give up on slow submission, got %v", err)
+	}
+
+	// Late share must not be submitted after shutdown gave up waiting
+	_, body := post(t, url, submitWork("0x0000000000010001", testHeader))
+	if code := errorCode(t, body); code != errShuttingDown.Code {
+		t.Errorf("Expected submission refused on shutdown, got %s", body)
+	}
+	if body := <-replies; errorCode(t, body) != 0 {
+		t.Errorf("Expected pending block accepted, got %s", body)
+	}
+	if calls := n.callsOf("eth_submitWork"); calls != 1 {
+		t.Errorf("Expected one submission, got %v", calls)
+	}
+}
+
+func TestShutdownWaitsForSubmission(t *testing.T) {
+	n := newTestNode(t)
+	n.submitDelay = 200 * time.Millisecond
+	s, url := newTestProxy(t, n, nil)
+
+	replies := make(chan string, 1)
+	go func() {
+		_, body := post(t, url, submitWork(testBlockNonce, testHeader))
+		replies <- body
+	}()
+	<-n.submitted
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected pending submission finished, got %v", err)
+	}
+	if atomic.LoadUint64(&s.rpc().Accepts) != 1 {
+		t.Error("Shutdown returned before block was accepted")
+	}
+	<-replies
+}
+
+func TestCoinbaseMismatch(t *testing.T) {
+	failing, wrong, right := newTestNode(t), newTestNode(t), newTestNode(t)
+	failing.noCoinbase = true
+	wrong.coinbase = "0x0000000000000000000000000000000000000002"
+	etherbase := strings.ToUpper(right.coinbase[:2]) + right.coinbase[2:]
+	s, url := newTestProxy(t, failing, func(cfg *Config) {
+		cfg.Upstream = []Upstream{
+			{Name: "failing", Url: failing.URL, Timeout: "5s", Etherbase: etherbase},
+			{Name: "wrong", Url: wrong.URL, Timeout: "5s", Etherbase: etherbase},
+			{Name: "right", Url: right.URL, Timeout: "5s", Etherbase: etherbase},
+		}
+	})
+	if s.rpc().Name != "right" {
+		t.Fatalf("Expected to start on upstream with right coinbase, got %s", s.rpc().Name)
+	}
+	s.checkUpstreams()
+	if s.rpc().Name != "right" {
+		t.Errorf("Expected to stay on upstream with right coinbase, got %s", s.rpc().Name)
+	}
+
+	// Shares are refused while current upstream mines elsewhere
+	right.Lock()
+	right.coinbase = wrong.coinbase
+	right.Unlock()
+	s.checkUpstreams()
+	_, body := post(t, url, submitWork(testShareNonce, testHeader))
+	if errorCode(t, body) != -1 || right.callsOf("eth_submitWork") != 0 {
+		t.Errorf("Expected share refused on coinbase mismatch, got %s", body)
+	}
+	if s.upstreams[0].Coinbase() != "" || !s.upstreams[0].CoinbaseMismatch() {
+		t.Error("Upstream failing coinbase request must be mismatched")
+	}
+}
+
+func TestCheckUpstreamsSchedule(t *testing.T) {
+	main, backup := newTestNode(t), newTestNode(t)
+	// Window of another day is never active today
+	other := time.Now().Add(48*time.Hour).Format("Mon") + " 00:00-24:00"
+	s, _ := newTestProxy(t, main, func(cfg *Config) {
+		cfg.Upstream = []Upstream{
+			{Name: "main", Url: main.URL, Timeout: "5s", Schedule: []string{other}},
+			{Name: "backup", Url: backup.URL, Timeout: "5s"},
+		}
+	})
+	if s.rpc().Name != "backup" {
+		t.Fatalf("Expected to start on backup out of main schedule, got %s", s.rpc().Name)
+	}
+
+	// Backup is out of schedule too, nothing is better than current upstream
+	s.schedules[1], _ = NewUpstreamSchedule([]string{other}, "")
+	s.checkUpstreams()
+	if s.rpc().Name != "backup" {
+		t.Errorf("Expected to stay on backup when no upstream is eligible, got %s", s.rpc().Name)
+	}
+
+	s.schedules[0] = nil
+	s.checkUpstreams()
+	if s.rpc().Name != "main" {
+		t.Errorf("Expected switch to main within its schedule, got %s", s.rpc().Name)
+	}
+}
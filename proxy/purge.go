@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"../util"
+)
+
+// Evicts miners without shares for longer than retention
+func (s *ProxyServer) expireMiners() {
+	if s.minerRetention <= 0 {
+		return
+	}
+	isExpired := func(m *Miner) bool {
+		return util.MakeTimestamp()-m.lastSeen() > s.minerRetention
+	}
+	// Map must not be modified while iterating, so ids are collected first
+	var expired []string
+	for m := range s.miners.Iter() {
+		if isExpired(m.Val) {
+			expired = append(expired, m.Key)
+		}
+	}
+	if len(expired) > 0 {
+		purged := s.purgeMiners(expired, isExpired)
+		log.Printf("Expired %v miners without shares for %v", purged, s.config.Proxy.MinerRetention)
+	}
+}
+
+// Removes miners by id and archives their final stats, returns number of removed miners.
+// Miners for which check, if given, no longer holds, e.g. came back since ids were collected, are kept.
+func (s *ProxyServer) purgeMiners(ids []string, check func(m *Miner) bool) int {
+	now := util.MakeTimestamp()
+	var archive *os.File
+	if len(s.config.Proxy.MinerArchive) > 0 {
+		f, err := os.OpenFile(s.config.Proxy.MinerArchive, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("Unable to open miners archive: %v", err)
+		} else {
+			archive = f
+			defer archive.Close()
+		}
+	}
+
+	count := 0
+	for _, id := range ids {
+		m, ok := s.miners.Get(id)
+		if !ok || (check != nil && !check(m)) {
+			continue
+		}
+		s.miners.Remove(id)
+		s.alerts.forget(id)
+		count++
+		if archive == nil {
+			continue
+		}
+		stats := s.convertMiner(m, now)
+		stats["startedAt"] = m.getStartedAt()
+		stats["evictedAt"] = now
+		if err := json.NewEncoder(archive).Encode(stats); err != nil {
+			log.Printf("Unable to archive miner %v: %v", id, err)
+		}
+	}
+	return count
+}
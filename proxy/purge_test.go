@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+func newTestMinersServer(t *testing.T) *ProxyServer {
+	cfg := &Config{Proxy: Proxy{MinerRetention: "1h", MinerArchive: filepath.Join(t.TempDir(), "miners.jsonl")}}
+	return &ProxyServer{
+		config:         cfg,
+		miners:         NewMinersMap(),
+		minerRetention: int64(time.Hour / time.Millisecond),
+		hashrateWindow: 15 * time.Minute,
+		timeout:        3 * time.Minute,
+	}
+}
+
+func addTestMiner(s *ProxyServer, id string, startedAt, lastBeat int64) *Miner {
+	m := NewMiner(id, "10.0.0.1")
+	m.startedAt = startedAt
+	m.lastBeat = lastBeat
+	s.registerMiner(m)
+	return m
+}
+
+func TestExpireMiners(t *testing.T) {
+	s := newTestMinersServer(t)
+	now := util.MakeTimestamp()
+	hour := int64(time.Hour / time.Millisecond)
+	addTestMiner(s, "dead", now-3*hour, now-2*hour)
+	addTestMiner(s, "silent", now-2*hour, 0)
+	addTestMiner(s, "alive", now-3*hour, now-hour/2)
+	addTestMiner(s, "new", now, 0)
+
+	s.expireMiners()
+	for id, kept := range map[string]bool{"dead": false, "silent": false, "alive": true, "new": true} {
+		if _, ok := s.miners.Get(id); ok != kept {
+			t.Errorf("Miner %s: expected kept %v", id, kept)
+		}
+	}
+
+	data, err := ioutil.ReadFile(s.config.Proxy.MinerArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 archived miners, got %q", data)
+	}
+	archived := make(map[string]bool)
+	for _, line := range lines {
+		var stats map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats["evictedAt"] == nil || stats["startedAt"] == nil {
+			t.Errorf("Archived miner misses timestamps: %s", line)
+		}
+		archived[stats["name"].(string)] = true
+	}
+	if !archived["dead"] || !archived["silent"] {
+		t.Errorf("Wrong miners archived: %v", archived)
+	}
+
+	// Miner which came back since ids were collected is kept
+	if n := s.purgeMiners([]string{"alive"}, func(*Miner) bool { return false }); n != 0 {
+		t.Errorf("Expected no miners purged, got %v", n)
+	}
+}
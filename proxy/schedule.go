@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type scheduleWindow struct {
+	days     [7]bool
+	from, to int
+}
+
+// Time windows when upstream may be used, e.g. "Mon-Fri 22:00-06:00" or "Sat,Sun 00:00-24:00".
+// Days are optional, window crossing midnight belongs to the day it starts on.
+type UpstreamSchedule struct {
+	specs    []string
+	windows  []scheduleWindow
+	location *time.Location
+}
+
+func NewUpstreamSchedule(specs []string, timezone string) (*UpstreamSchedule, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	sc := &UpstreamSchedule{specs: specs, location: time.Local}
+	if len(timezone) > 0 {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		sc.location = location
+	}
+	for _, spec := range specs {
+		w, err := parseScheduleWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", spec, err)
+		}
+		sc.windows = append(sc.windows, w)
+	}
+	return sc, nil
+}
+
+func parseScheduleWindow(spec string) (scheduleWindow, error) {
+	var w scheduleWindow
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("expected [days] hh:mm-hh:mm")
+	}
+	if len(fields) == 1 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			first, ok := weekdays[strings.ToLower(bounds[0])]
+			if !ok {
+				return w, fmt.Errorf("unknown day %s", bounds[0])
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, ok = weekdays[strings.ToLower(bounds[1])]; !ok {
+					return w, fmt.Errorf("unknown day %s", bounds[1])
+				}
+			}
+			// Ranges may wrap around the week, e.g. Fri-Mon
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	hours := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(hours) != 2 {
+		return w, fmt.Errorf("expected hh:mm-hh:mm")
+	}
+	var err error
+	if w.from, err = parseClock(hours[0]); err != nil {
+		return w, err
+	}
+	if w.to, err = parseClock(hours[1]); err != nil {
+		return w, err
+	}
+	if w.from == w.to {
+		return w, fmt.Errorf("empty window")
+	}
+	return w, nil
+}
+
+// Returns minutes since midnight, 24:00 is allowed as the end of day
+func parseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w *scheduleWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from < w.to {
+		return w.days[day] && minute >= w.from && minute < w.to
+	}
+	// Crosses midnight, tail belongs to previous day
+	prev := (day + 6) % 7
+	return (w.days[day] && minute >= w.from) || (w.days[prev] && minute < w.to)
+}
+
+// Upstream without schedule is always active
+func (sc *UpstreamSchedule) active(t time.Time) bool {
+	if sc == nil {
+		return true
+	}
+	t = t.In(sc.location)
+	for i := range sc.windows {
+		if sc.windows[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// 2024-01-01 is Monday
+func testTime(day, hour, minute int) time.Time {
+	return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleWindows(t *testing.T) {
+	for _, v := range []struct {
+		spec   string
+		at     time.Time
+		active bool
+	}{
+		{"22:00-06:00", testTime(1, 23, 0), true},
+		{"22:00-06:00", testTime(2, 5, 59), true},
+		{"22:00-06:00", testTime(2, 6, 0), false},
+		{"22:00-06:00", testTime(1, 21, 59), false},
+		// Tail after midnight belongs to the day window starts on
+		{"Fri 22:00-06:00", testTime(5, 23, 0), true},
+		{"Fri 22:00-06:00", testTime(6, 3, 0), true},
+		{"Fri 22:00-06:00", testTime(5, 3, 0), false},
+		{"Fri 22:00-06:00", testTime(6, 23, 0), false},
+		{"Sun 22:00-06:00", testTime(8, 3, 0), true},
+		{"Sat,Sun 00:00-24:00", testTime(6, 0, 0), true},
+		{"Sat,Sun 00:00-24:00", testTime(7, 23, 59), true},
+		{"Sat,Sun 00:00-24:00", testTime(8, 0, 0), false},
+		{"18:00-24:00", testTime(1, 23, 59), true},
+		{"18:00-24:00", testTime(2, 0, 0), false},
+		{"Fri-Mon 09:00-17:00", testTime(7, 12, 0), true},
+		{"Fri-Mon 09:00-17:00", testTime(3, 12, 0), false},
+	} {
+		sc, err := NewUpstreamSchedule([]string{v.spec}, "UTC")
+		if err != nil {
+			t.Errorf("%s: %v", v.spec, err)
+			continue
+		}
+		if active := sc.active(v.at); active != v.active {
+			t.Errorf("%s at %v: expected active %v", v.spec, v.at.Format("Mon 15:04"), v.active)
+		}
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+	sc, err := NewUpstreamSchedule([]string{"09:00-17:00"}, "Asia/Tokyo")
+	if err != nil {
+		t.Skipf("No timezone data: %v", err)
+	}
+	// 01:00 UTC is 10:00 in Tokyo
+	if !sc.active(testTime(1, 1, 0)) || sc.active(testTime(1, 9, 0)) {
+		t.Error("Schedule must be interpreted in its timezone")
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "10:00", "10:00-10:00", "24:01-02:00", "25:00-01:00", "10:60-11:00", "Xyz 10:00-11:00", "Mon 10:00-11:00 extra"} {
+		if _, err := NewUpstreamSchedule([]string{spec}, ""); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+	if _, err := NewUpstreamSchedule([]string{"10:00-11:00"}, "Nowhere/City"); err == nil {
+		t.Error("Expected error for unknown timezone")
+	}
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+var seriesStep = int64(time.Minute / time.Millisecond)
+
+type SeriesStats struct {
+	Work     int64             `json:"work"`
+	Hashrate int64             `json:"hashrate"`
+	Shares   map[string]uint64 `json:"shares"`
+}
+
+type SeriesPoint struct {
+	Timestamp int64 `json:"timestamp"`
+	SeriesStats
+	Upstreams map[string]*SeriesStats `json:"upstreams"`
+}
+
+type SeriesResolution struct {
+	Name      string         `json:"name"`
+	Step      int64          `json:"step"`
+	Retention int64          `json:"retention"`
+	Points    []*SeriesPoint `json:"points"`
+}
+
+// Farm-wide hashrate and shares, collected per minute and downsampled
+// into hourly and daily points, each kept for its own retention.
+type TimeSeries struct {
+	sync.Mutex
+	path        string
+	loaded      bool
+	current     *SeriesPoint
+	resolutions []*SeriesResolution
+}
+
+func NewTimeSeries(cfg *History) *TimeSeries {
+	ts := &TimeSeries{path: cfg.Path}
+	for _, v := range []struct {
+		name, retention string
+		step, fallback  time.Duration
+	}{
+		{"minute", cfg.MinuteRetention, time.Minute, 24 * time.Hour},
+		{"hour", cfg.HourRetention, time.Hour, 30 * 24 * time.Hour},
+		{"day", cfg.DayRetention, 24 * time.Hour, 365 * 24 * time.Hour},
+	} {
+		retention, err := time.ParseDuration(v.retention)
+		if err != nil {
+			retention = v.fallback
+		}
+		ts.resolutions = append(ts.resolutions, &SeriesResolution{
+			Name:      v.name,
+			Step:      int64(v.step / time.Millisecond),
+			Retention: int64(retention / time.Millisecond),
+		})
+	}
+	return ts
+}
+
+func newSeriesStats() *SeriesStats {
+	return &SeriesStats{Shares: make(map[string]uint64)}
+}
+
+func (st *SeriesStats) merge(other *SeriesStats) {
+	st.Work += other.Work
+	for k, v := range other.Shares {
+		st.Shares[k] += v
+	}
+}
+
+func (p *SeriesPoint) merge(other *SeriesPoint) {
+	p.SeriesStats.merge(&other.SeriesStats)
+	for name, v := range other.Upstreams {
+		u, ok := p.Upstreams[name]
+		if !ok {
+			u = newSeriesStats()
+			p.Upstreams[name] = u
+		}
+		u.merge(v)
+	}
+}
+
+func newSeriesPoint(ts int64) *SeriesPoint {
+	return &SeriesPoint{Timestamp: ts, SeriesStats: *newSeriesStats(), Upstreams: make(map[string]*SeriesStats)}
+}
+
+// Counts share of given kind submitted to upstream, work is for valid shares only
+func (ts *TimeSeries) add(upstream, kind string, work int64) {
+	if ts == nil {
+		return
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	ts.roll(util.MakeTimestamp())
+
+	p := ts.current
+	u, ok := p.Upstreams[upstream]
+	if !ok {
+		u = newSeriesStats()
+		p.Upstreams[upstream] = u
+	}
+	p.Shares[kind]++
+	u.Shares[kind]++
+	p.Work += work
+	u.Work += work
+}
+
+// Moves completed minute into every resolution, must be called under lock
+func (ts *TimeSeries) roll(now int64) {
+	start := now - now%seriesStep
+	if ts.current != nil && ts.current.Timestamp == start {
+		return
+	}
+	if ts.current != nil {
+		for _, r := range ts.resolutions {
+			bucket := ts.current.Timestamp - ts.current.Timestamp%r.Step
+			n := len(r.Points)
+			if n > 0 && r.Points[n-1].Timestamp == bucket {
+				r.Points[n-1].merge(ts.current)
+			} else {
+				p := newSeriesPoint(bucket)
+				p.merge(ts.current)
+				r.Points = append(r.Points, p)
+			}
+			i := 0
+			for i < len(r.Points) && r.Points[i].Timestamp < now-r.Retention {
+				i++
+			}
+			r.Points = r.Points[i:]
+		}
+	}
+	ts.current = newSeriesPoint(start)
+}
+
+func (ts *TimeSeries) tick() {
+	ts.Lock()
+	ts.roll(util.MakeTimestamp())
+	ts.Unlock()
+}
+
+// Flushes incomplete minute and saves history, no shares must be added afterwards
+func (ts *TimeSeries) Close() error {
+	if ts == nil {
+		return nil
+	}
+	ts.Lock()
+	if ts.current != nil {
+		ts.roll(ts.current.Timestamp + seriesStep)
+	}
+	ts.Unlock()
+	return ts.Save()
+}
+
+// Returns copy of points with hashrate computed for given resolution
+func (ts *TimeSeries) points(resolution string) (*SeriesResolution, bool) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, r := range ts.resolutions {
+		if r.Name != resolution {
+			continue
+		}
+		result := &SeriesResolution{Name: r.Name, Step: r.Step, Retention: r.Retention}
+		for _, v := range r.Points {
+			p := newSeriesPoint(v.Timestamp)
+			p.merge(v)
+			// Bucket still being filled holds only minutes rolled into it so far
+			duration := r.Step
+			if ts.current != nil {
+				if elapsed := ts.current.Timestamp - v.Timestamp; elapsed > 0 && elapsed < duration {
+					duration = elapsed
+				}
+			}
+			p.Hashrate = p.Work / duration
+			for _, u := range p.Upstreams {
+				u.Hashrate = u.Work / duration
+			}
+			result.Points = append(result.Points, p)
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// Merges history saved by previous run, or by parent process into points collected since upgrade
+func (ts *TimeSeries) reload() error {
+	if ts == nil || len(ts.path) == 0 {
+		return nil
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	// File may be written from now on, even when it's missing or broken
+	ts.loaded = true
+	data, err := ioutil.ReadFile(ts.path)
+	if err != nil {
+		return err
+	}
+	var saved []*SeriesResolution
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for _, v := range saved {
+		for _, r := range ts.resolutions {
+			if r.Name == v.Name && r.Step == v.Step {
+				r.Points = mergePoints(v.Points, r.Points)
+			}
+		}
+	}
+	return nil
+}
+
+// Sums points of the same timestamp, result is ordered by time
+func mergePoints(a, b []*SeriesPoint) []*SeriesPoint {
+	byTimestamp := make(map[int64]*SeriesPoint)
+	for _, points := range [][]*SeriesPoint{a, b} {
+		for _, v := range points {
+			p, ok := byTimestamp[v.Timestamp]
+			if !ok {
+				p = newSeriesPoint(v.Timestamp)
+				byTimestamp[v.Timestamp] = p
+			}
+			p.merge(v)
+		}
+	}
+	result := make([]*SeriesPoint, 0, len(byTimestamp))
+	for _, p := range byTimestamp {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+	return result
+}
+
+// Nothing is written until reload, upgraded process must not overwrite state of its parent
+func (ts *TimeSeries) Save() error {
+	if ts == nil || len(ts.path) == 0 {
+		return nil
+	}
+	ts.Lock()
+	if !ts.loaded {
+		ts.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(ts.resolutions)
+	ts.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := ts.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ts.path)
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func seriesWork(ts *TimeSeries) int64 {
+	r, _ := ts.points("minute")
+	work := int64(0)
+	for _, p := range r.Points {
+		work += p.Work
+	}
+	return work
+}
+
+func TestSeriesSavedAfterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	parent := NewTimeSeries(&History{Path: path})
+	parent.reload()
+	parent.add("main", shareValid, 100)
+	if err := parent.Close(); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := ioutil.ReadFile(path)
+
+	// Upgraded process collects shares before it merges state of parent
+	child := NewTimeSeries(&History{Path: path})
+	child.add("main", shareValid, 50)
+	child.Close()
+	if data, _ := ioutil.ReadFile(path); string(data) != string(saved) {
+		t.Fatal("History of parent was overwritten before reload")
+	}
+
+	if err := child.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Save(); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewTimeSeries(&History{Path: path})
+	restored.reload()
+	if work := seriesWork(restored); work != 150 {
+		t.Errorf("Expected merged work of 150, got %v", work)
+	}
+}
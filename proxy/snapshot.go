@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+
+	"../rpc"
+)
+
+// State carried over to a new process on binary upgrade
+type Snapshot struct {
+	Upstream    string               `json:"upstream"`
+	Upstreams   []UpstreamSnapshot   `json:"upstreams"`
+	Miners      []MinerSnapshot      `json:"miners"`
+	RoundShares int64                `json:"roundShares"`
+	Blocks      uint64               `json:"blocks"`
+	BlockStats  map[int64]float64    `json:"blockStats"`
+	Chains      map[string]*Snapshot `json:"chains,omitempty"`
+	Fee         *FeeSnapshot         `json:"fee,omitempty"`
+}
+
+type UpstreamSnapshot struct {
+	Name             string `json:"name"`
+	Accepts          uint64 `json:"accepts"`
+	Rejects          uint64 `json:"rejects"`
+	LastSubmissionAt int64  `json:"lastSubmissionAt"`
+	FailsCount       uint64 `json:"failsCount"`
+	ValidShares      uint64 `json:"validShares"`
+	InvalidShares    uint64 `json:"invalidShares"`
+	StaleShares      uint64 `json:"staleShares"`
+	MalformedShares  uint64 `json:"malformedShares"`
+	DuplicateShares  uint64 `json:"duplicateShares"`
+}
+
+type MinerSnapshot struct {
+	Id              string                      `json:"id"`
+	IP              string                      `json:"ip"`
+	StartedAt       int64                       `json:"startedAt"`
+	LastBeat        int64                       `json:"lastBeat"`
+	ValidShares     uint64                      `json:"validShares"`
+	InvalidShares   uint64                      `json:"invalidShares"`
+	StaleShares     uint64                      `json:"staleShares"`
+	MalformedShares uint64                      `json:"malformedShares"`
+	DuplicateShares uint64                      `json:"duplicateShares"`
+	Accepts         uint64                      `json:"accepts"`
+	Rejects         uint64                      `json:"rejects"`
+	Shares          map[int64]int64             `json:"shares"`
+	History         map[int64]map[string]uint64 `json:"history"`
+	Info            MinerInfo                   `json:"info"`
+}
+
+func (s *ProxyServer) Snapshot() *Snapshot {
+	snap := &Snapshot{
+		Upstream:    s.rpc().Name,
+		RoundShares: atomic.LoadInt64(&s.roundShares),
+		Blocks:      atomic.LoadUint64(&s.blocks),
+		BlockStats:  make(map[int64]float64),
+	}
+	for _, u := range s.upstreams {
+		snap.Upstreams = append(snap.Upstreams, snapshotUpstream(u))
+	}
+	snap.Fee = s.fee.snapshot()
+	for m := range s.miners.Iter() {
+		snap.Miners = append(snap.Miners, m.Val.snapshot())
+	}
+	s.blocksMu.RLock()
+	for k, v := range s.blockStats {
+		snap.BlockStats[k] = v
+	}
+	s.blocksMu.RUnlock()
+	return snap
+}
+
+// Merges state of parent process into endpoint, which already serves miners since upgrade
+func (s *ProxyServer) Restore(snap *Snapshot) {
+	for _, us := range snap.Upstreams {
+		for i, u := range s.upstreams {
+			if u.Name != us.Name {
+				continue
+			}
+			restoreUpstream(u, &us)
+			if us.Name == snap.Upstream {
+				atomic.StoreInt32(&s.upstream, int32(i))
+			}
+		}
+	}
+	s.fee.restore(snap.Fee)
+	for _, ms := range snap.Miners {
+		if m, ok := s.miners.Get(ms.Id); ok {
+			m.merge(&ms)
+		} else {
+			s.registerMiner(restoreMiner(&ms))
+		}
+	}
+	atomic.AddInt64(&s.roundShares, snap.RoundShares)
+	atomic.AddUint64(&s.blocks, snap.Blocks)
+	s.blocksMu.Lock()
+	for k, v := range snap.BlockStats {
+		s.blockStats[k] = v
+	}
+	s.blocksMu.Unlock()
+	s.loadState()
+	log.Printf("Restored state of %v miners and %v upstreams, current upstream: %s", len(snap.Miners), len(snap.Upstreams), s.rpc().Name)
+}
+
+func snapshotUpstream(u *rpc.RPCClient) UpstreamSnapshot {
+	return UpstreamSnapshot{
+		Name:             u.Name,
+		Accepts:          atomic.LoadUint64(&u.Accepts),
+		Rejects:          atomic.LoadUint64(&u.Rejects),
+		LastSubmissionAt: atomic.LoadInt64(&u.LastSubmissionAt),
+		FailsCount:       atomic.LoadUint64(&u.FailsCount),
+		ValidShares:      atomic.LoadUint64(&u.ValidShares),
+		InvalidShares:    atomic.LoadUint64(&u.InvalidShares),
+		StaleShares:      atomic.LoadUint64(&u.StaleShares),
+		MalformedShares:  atomic.LoadUint64(&u.MalformedShares),
+		DuplicateShares:  atomic.LoadUint64(&u.DuplicateShares),
+	}
+}
+
+// Counters of parent process are added to ones collected since upgrade
+func restoreUpstream(u *rpc.RPCClient, us *UpstreamSnapshot) {
+	atomic.AddUint64(&u.Accepts, us.Accepts)
+	atomic.AddUint64(&u.Rejects, us.Rejects)
+	if us.LastSubmissionAt > atomic.LoadInt64(&u.LastSubmissionAt) {
+		atomic.StoreInt64(&u.LastSubmissionAt, us.LastSubmissionAt)
+	}
+	atomic.AddUint64(&u.FailsCount, us.FailsCount)
+	atomic.AddUint64(&u.ValidShares, us.ValidShares)
+	atomic.AddUint64(&u.InvalidShares, us.InvalidShares)
+	atomic.AddUint64(&u.StaleShares, us.StaleShares)
+	atomic.AddUint64(&u.MalformedShares, us.MalformedShares)
+	atomic.AddUint64(&u.DuplicateShares, us.DuplicateShares)
+}
+
+func (m *Miner) snapshot() MinerSnapshot {
+	ms := MinerSnapshot{
+		Id:              m.Id,
+		IP:              m.IP,
+		StartedAt:       m.getStartedAt(),
+		LastBeat:        m.getLastBeat(),
+		ValidShares:     atomic.LoadUint64(&m.validShares),
+		InvalidShares:   atomic.LoadUint64(&m.invalidShares),
+		StaleShares:     atomic.LoadUint64(&m.staleShares),
+		MalformedShares: atomic.LoadUint64(&m.malformedShares),
+		DuplicateShares: atomic.LoadUint64(&m.duplicateShares),
+		Accepts:         atomic.LoadUint64(&m.accepts),
+		Rejects:         atomic.LoadUint64(&m.rejects),
+		Shares:          make(map[int64]int64),
+		History:         make(map[int64]map[string]uint64),
+		Info:            m.getInfo(),
+	}
+	m.RLock()
+	for k, v := range m.shares {
+		ms.Shares[k] = v
+	}
+	for k, v := range m.history {
+		bucket := make(map[string]uint64)
+		for kind, n := range v {
+			bucket[kind] = n
+		}
+		ms.History[k] = bucket
+	}
+	m.RUnlock()
+	return ms
+}
+
+func restoreMiner(ms *MinerSnapshot) *Miner {
+	m := NewMiner(ms.Id, ms.IP)
+	m.startedAt = ms.StartedAt
+	m.lastBeat = ms.LastBeat
+	m.validShares = ms.ValidShares
+	m.invalidShares = ms.InvalidShares
+	m.staleShares = ms.StaleShares
+	m.malformedShares = ms.MalformedShares
+	m.duplicateShares = ms.DuplicateShares
+	m.accepts = ms.Accepts
+	m.rejects = ms.Rejects
+	m.info = ms.Info
+	for k, v := range ms.Shares {
+		m.shares[k] = v
+	}
+	for k, v := range ms.History {
+		m.history[k] = v
+	}
+	return m
+}
+
+// Adds parent process state of miner which already submitted to this process
+func (m *Miner) merge(ms *MinerSnapshot) {
+	if ms.StartedAt < m.getStartedAt() {
+		atomic.StoreInt64(&m.startedAt, ms.StartedAt)
+	}
+	if ms.LastBeat > m.getLastBeat() {
+		atomic.StoreInt64(&m.lastBeat, ms.LastBeat)
+	}
+	atomic.AddUint64(&m.validShares, ms.ValidShares)
+	atomic.AddUint64(&m.invalidShares, ms.InvalidShares)
+	atomic.AddUint64(&m.staleShares, ms.StaleShares)
+	atomic.AddUint64(&m.malformedShares, ms.MalformedShares)
+	atomic.AddUint64(&m.duplicateShares, ms.DuplicateShares)
+	atomic.AddUint64(&m.accepts, ms.Accepts)
+	atomic.AddUint64(&m.rejects, ms.Rejects)
+	m.Lock()
+	defer m.Unlock()
+	for k, v := range ms.Shares {
+		m.shares[k] += v
+	}
+	for k, v := range ms.History {
+		bucket, ok := m.history[k]
+		if !ok {
+			bucket = make(map[string]uint64)
+			m.history[k] = bucket
+		}
+		for kind, n := range v {
+			bucket[kind] += n
+		}
+	}
+	// Reports received since upgrade are newer
+	if ms.Info.ReportedAt > m.info.ReportedAt {
+		m.info.ReportedHashrate = ms.Info.ReportedHashrate
+		m.info.ReportedAt = ms.Info.ReportedAt
+	}
+	if len(m.info.Worker) == 0 {
+		m.info.Worker = ms.Info.Worker
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"../rpc"
+)
+
+func newTestUpgradeServer(t *testing.T) *ProxyServer {
+	var upstreams []*rpc.RPCClient
+	for _, name := range []string{"main", "backup"} {
+		client, err := rpc.NewRPCClient(name, "http://127.0.0.1:1", "1s", "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, client)
+	}
+	return &ProxyServer{config: &Config{}, miners: NewMinersMap(), blockStats: make(map[int64]float64), upstreams: upstreams}
+}
+
+func TestRestoreMerge(t *testing.T) {
+	parent := newTestUpgradeServer(t)
+	rig1 := NewMiner("rig1", "10.0.0.1")
+	rig1.validShares = 5
+	rig1.shares[1000] = 50
+	parent.registerMiner(rig1)
+	rig2 := NewMiner("rig2", "10.0.0.2")
+	rig2.validShares = 1
+	parent.registerMiner(rig2)
+	parent.upstreams[1].Accepts = 3
+	atomic.StoreInt32(&parent.upstream, 1)
+	parent.roundShares = 100
+	parent.blocks = 2
+	parent.blockStats[1000] = 0.5
+	snap := parent.Snapshot()
+
+	// Miner submitted to new process before it got parent state
+	child := newTestUpgradeServer(t)
+	rig1 = NewMiner("rig1", "10.0.0.1")
+	rig1.validShares = 2
+	rig1.shares[1000] = 20
+	rig1.shares[2000] = 20
+	child.registerMiner(rig1)
+	child.roundShares = 10
+	child.Restore(snap)
+
+	if m, ok := child.miners.Get("rig1"); !ok || m.validShares != 7 || m.shares[1000] != 70 || m.shares[2000] != 20 {
+		t.Errorf("Miner state was not merged: %+v", m)
+	}
+	if m, ok := child.miners.Get("rig2"); !ok || m.validShares != 1 || m.IP != "10.0.0.2" {
+		t.Errorf("Miner of parent was not restored: %+v", m)
+	}
+	if child.rpc().Name != "backup" || child.upstreams[1].Accepts != 3 {
+		t.Errorf("Upstream state was not restored, current %s", child.rpc().Name)
+	}
+	if child.roundShares != 110 || child.blockStats[1000] != 0.5 {
+		t.Errorf("Round state was not merged: %v, %v", child.roundShares, child.blockStats)
+	}
+	if child.blocks != 2 {
+		t.Errorf("Expected 2 blocks restored, got %v", child.blocks)
+	}
+}
@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+
+	"../util"
+)
+
+const (
+	schemePPLNS = "pplns"
+	schemePROP  = "prop"
+
+	maxRoundResults = 100
+)
+
+type pplnsBucket struct {
+	Timestamp int64            `json:"timestamp"`
+	Total     int64            `json:"total"`
+	Shares    map[string]int64 `json:"shares"`
+}
+
+type RoundResult struct {
+	Height    uint64            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Finder    string            `json:"finder"`
+	Reward    string            `json:"reward"`
+	Shares    int64             `json:"shares"`
+	Credits   map[string]string `json:"credits"`
+}
+
+// Credits solo blocks to accounts of a local sub-pool by PPLNS or proportional scheme.
+// Only balances are tracked, no payouts are made.
+type RewardPool struct {
+	sync.Mutex
+	saveMu   sync.Mutex
+	scheme   string
+	groupBy  string
+	window   float64
+	reward   *big.Int
+	fee      float64
+	path     string
+	loaded   bool
+	Round    map[string]int64    `json:"round"`
+	Recent   []*pplnsBucket      `json:"recent"`
+	Balances map[string]*big.Int `json:"balances"`
+	Results  []*RoundResult      `json:"results"`
+}
+
+func NewRewardPool(cfg *SubPool, blockReward string) *RewardPool {
+	p := &RewardPool{
+		scheme:   cfg.Scheme,
+		groupBy:  cfg.GroupBy,
+		window:   cfg.PPLNSWindow,
+		fee:      cfg.Fee,
+		path:     cfg.Path,
+		Round:    make(map[string]int64),
+		Balances: make(map[string]*big.Int),
+	}
+	if p.scheme != schemePROP {
+		p.scheme = schemePPLNS
+	}
+	if p.window <= 0 {
+		p.window = 2
+	}
+	reward, ok := new(big.Int).SetString(blockReward, 10)
+	if !ok {
+		log.Fatalf("Invalid block reward: %v", blockReward)
+	}
+	p.reward = reward
+	return p
+}
+
+// Account is miner id or its group on level set by groupBy
+func (s *ProxyServer) accountOf(id string) string {
+	if s.subpool != nil && len(s.subpool.groupBy) > 0 {
+		if name, ok := s.groups.groupsOf(id)[s.subpool.groupBy]; ok {
+			return name
+		}
+	}
+	return id
+}
+
+func (p *RewardPool) addShare(account string, diff int64, networkDiff *big.Int) {
+	if p == nil {
+		return
+	}
+	now := util.MakeTimestamp()
+	ts := now - now%seriesStep
+
+	p.Lock()
+	defer p.Unlock()
+	p.Round[account] += diff
+	if p.scheme != schemePPLNS {
+		return
+	}
+	n := len(p.Recent)
+	if n == 0 || p.Recent[n-1].Timestamp != ts {
+		// Good time to drop buckets which are out of window already
+		p.trim(p.windowLimit(networkDiff))
+		p.Recent = append(p.Recent, &pplnsBucket{Timestamp: ts, Shares: make(map[string]int64)})
+		n = len(p.Recent)
+	}
+	b := p.Recent[n-1]
+	b.Shares[account] += diff
+	b.Total += diff
+}
+
+// Splits block reward between accounts and starts a new round, returns credited amounts.
+// Balances are saved right away, share path must not wait for the file write.
+func (p *RewardPool) creditBlock(height uint64, finder string, networkDiff *big.Int) map[string]*big.Int {
+	if p == nil {
+		return nil
+	}
+	credits := p.credit(height, finder, networkDiff)
+	if err := p.Save(); err != nil {
+		log.Printf("Unable to save sub-pool state: %v", err)
+	}
+	return credits
+}
+
+func (p *RewardPool) credit(height uint64, finder string, networkDiff *big.Int) map[string]*big.Int {
+	p.Lock()
+	defer p.Unlock()
+
+	var shares map[string]int64
+	if p.scheme == schemePROP {
+		shares = p.Round
+	} else {
+		shares = p.lastNShares(networkDiff)
+	}
+	total := int64(0)
+	for _, v := range shares {
+		total += v
+	}
+
+	result := &RoundResult{
+		Height:    height,
+		Timestamp: util.MakeTimestamp(),
+		Finder:    finder,
+		Reward:    p.reward.String(),
+		Shares:    total,
+		Credits:   make(map[string]string),
+	}
+	credits := make(map[string]*big.Int)
+	if total > 0 {
+		// Operator fee stays undistributed
+		payable := new(big.Int).Mul(p.reward, big.NewInt(int64((100-p.fee)*100)))
+		payable.Div(payable, big.NewInt(10000))
+		for account, v := range shares {
+			amount := new(big.Int).Mul(payable, big.NewInt(v))
+			amount.Div(amount, big.NewInt(total))
+			if _, ok := p.Balances[account]; !ok {
+				p.Balances[account] = new(big.Int)
+			}
+			p.Balances[account].Add(p.Balances[account], amount)
+			result.Credits[account] = amount.String()
+			credits[account] = amount
+		}
+	}
+	p.Results = append(p.Results, result)
+	if len(p.Results) > maxRoundResults {
+		p.Results = p.Results[len(p.Results)-maxRoundResults:]
+	}
+	p.Round = make(map[string]int64)
+	log.Printf("Credited block %v to %v sub-pool accounts by %s", height, len(result.Credits), p.scheme)
+	return credits
+}
+
+func (p *RewardPool) windowLimit(networkDiff *big.Int) int64 {
+	limit, _ := new(big.Float).Mul(new(big.Float).SetInt(networkDiff), big.NewFloat(p.window)).Int64()
+	return limit
+}
+
+// Drops buckets older than the one reaching the limit, must be called under lock
+func (p *RewardPool) trim(limit int64) {
+	sum := int64(0)
+	i := len(p.Recent) - 1
+	for ; i >= 0 && sum < limit; i-- {
+		sum += p.Recent[i].Total
+	}
+	p.Recent = p.Recent[i+1:]
+}
+
+// Returns shares per account of last window * network difficulty, must be called under lock
+func (p *RewardPool) lastNShares(networkDiff *big.Int) map[string]int64 {
+	limit := p.windowLimit(networkDiff)
+	p.trim(limit)
+	result := make(map[string]int64)
+	sum := int64(0)
+	for i := len(p.Recent) - 1; i >= 0; i-- {
+		b := p.Recent[i]
+		// Take only needed fraction of the oldest bucket
+		fraction := 1.0
+		if sum+b.Total > limit {
+			fraction = float64(limit-sum) / float64(b.Total)
+		}
+		for account, v := range b.Shares {
+			result[account] += int64(float64(v) * fraction)
+		}
+		sum += b.Total
+	}
+	return result
+}
+
+type AccountStats struct {
+	Balance string `json:"balance"`
+	Round   int64  `json:"round"`
+}
+
+func (p *RewardPool) stats() map[string]interface{} {
+	p.Lock()
+	defer p.Unlock()
+	accounts := make(map[string]*AccountStats)
+	account := func(name string) *AccountStats {
+		a, ok := accounts[name]
+		if !ok {
+			a = &AccountStats{Balance: "0"}
+			accounts[name] = a
+		}
+		return a
+	}
+	for name, v := range p.Balances {
+		account(name).Balance = v.String()
+	}
+	for name, v := range p.Round {
+		account(name).Round = v
+	}
+	return map[string]interface{}{
+		"scheme":   p.scheme,
+		"groupBy":  p.groupBy,
+		"fee":      p.fee,
+		"reward":   p.reward.String(),
+		"accounts": accounts,
+		"results":  p.Results,
+	}
+}
+
+// Merges state saved by previous run, or by parent process into shares collected since upgrade
+func (p *RewardPool) reload() error {
+	if p == nil || len(p.path) == 0 {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	// File may be written from now on, even when it's missing or broken
+	p.loaded = true
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var saved RewardPool
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for account, v := range saved.Round {
+		p.Round[account] += v
+	}
+	for account, v := range saved.Balances {
+		if b, ok := p.Balances[account]; ok {
+			b.Add(b, v)
+		} else {
+			p.Balances[account] = v
+		}
+	}
+	p.Recent = mergeBuckets(saved.Recent, p.Recent)
+	p.Results = append(saved.Results, p.Results...)
+	if len(p.Results) > maxRoundResults {
+		p.Results = p.Results[len(p.Results)-maxRoundResults:]
+	}
+	return nil
+}
+
+// Sums buckets of the same minute, result is ordered by time
+func mergeBuckets(a, b []*pplnsBucket) []*pplnsBucket {
+	byTimestamp := make(map[int64]*pplnsBucket)
+	for _, buckets := range [][]*pplnsBucket{a, b} {
+		for _, v := range buckets {
+			bucket, ok := byTimestamp[v.Timestamp]
+			if !ok {
+				bucket = &pplnsBucket{Timestamp: v.Timestamp, Shares: make(map[string]int64)}
+				byTimestamp[v.Timestamp] = bucket
+			}
+			bucket.Total += v.Total
+			for account, diff := range v.Shares {
+				bucket.Shares[account] += diff
+			}
+		}
+	}
+	result := make([]*pplnsBucket, 0, len(byTimestamp))
+	for _, bucket := range byTimestamp {
+		result = append(result, bucket)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+	return result
+}
+
+// State is encoded under lock, file is written without holding it.
+// Nothing is written until reload, upgraded process must not overwrite state of its parent.
+func (p *RewardPool) Save() error {
+	if p == nil || len(p.path) == 0 {
+		return nil
+	}
+	p.Lock()
+	if !p.loaded {
+		p.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(p)
+	p.Unlock()
+	if err != nil {
+		return err
+	}
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+func (p *RewardPool) Close() error {
+	return p.Save()
+}
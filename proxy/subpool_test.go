@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+)
+
+func TestRewardPoolSavedAfterReload(t *testing.T) {
+	cfg := &SubPool{Path: filepath.Join(t.TempDir(), "subpool.json")}
+	parent := NewRewardPool(cfg, "1000")
+	parent.reload()
+	parent.addShare("rig1", 10, big.NewInt(1000))
+	if err := parent.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := ioutil.ReadFile(cfg.Path)
+
+	// Upgraded process collects shares before it merges state of parent
+	child := NewRewardPool(cfg, "1000")
+	child.addShare("rig2", 30, big.NewInt(1000))
+	child.Save()
+	if data, _ := ioutil.ReadFile(cfg.Path); string(data) != string(saved) {
+		t.Fatal("Sub-pool state of parent was overwritten before reload")
+	}
+
+	if err := child.reload(); err != nil {
+		t.Fatal(err)
+	}
+	credits := child.credit(1, "rig2", big.NewInt(1000))
+	if credits["rig1"].String() != "250" || credits["rig2"].String() != "750" {
+		t.Errorf("Expected block credited by merged shares, got %v", credits)
+	}
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+const maxSwitchDecisions = 100
+
+// Source of coin prices keyed by chain name
+type PriceFeed interface {
+	Prices() (map[string]float64, error)
+}
+
+type filePriceFeed struct {
+	path string
+}
+
+func (f *filePriceFeed) Prices() (map[string]float64, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var prices map[string]float64
+	err = json.NewDecoder(file).Decode(&prices)
+	return prices, err
+}
+
+type httpPriceFeed struct {
+	url    string
+	client *http.Client
+}
+
+func (f *httpPriceFeed) Prices() (map[string]float64, error) {
+	resp, err := f.client.Get(f.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("price feed replied with %s", resp.Status)
+	}
+	var prices map[string]float64
+	err = json.NewDecoder(resp.Body).Decode(&prices)
+	return prices, err
+}
+
+func NewPriceFeed(cfg *PriceFeedConfig) (PriceFeed, error) {
+	if len(cfg.Url) > 0 {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			timeout = 10 * time.Second
+		}
+		return &httpPriceFeed{url: cfg.Url, client: &http.Client{Timeout: timeout}}, nil
+	}
+	if len(cfg.Path) > 0 {
+		return &filePriceFeed{path: cfg.Path}, nil
+	}
+	return nil, errors.New("price feed url or path required")
+}
+
+type SwitchDecision struct {
+	Timestamp int64              `json:"timestamp"`
+	From      string             `json:"from"`
+	To        string             `json:"to"`
+	Switched  bool               `json:"switched"`
+	Reason    string             `json:"reason"`
+	Revenue   map[string]float64 `json:"revenue"`
+}
+
+// Moves miners of switching endpoint to the chain with best expected
+// revenue per hash, with hysteresis and minimum dwell time against flapping.
+type Switcher struct {
+	sync.RWMutex
+	chains     *ChainSet
+	feed       PriceFeed
+	path       string
+	rewards    map[string]*big.Float
+	hysteresis float64
+	minDwell   time.Duration
+	current    string
+	switchedAt time.Time
+	decisions  []*SwitchDecision
+	quit       chan struct{}
+}
+
+func NewSwitcher(cfg *Switching, chains *ChainSet) *Switcher {
+	feed, err := NewPriceFeed(&cfg.PriceFeed)
+	if err != nil {
+		log.Fatalf("Invalid switching config: %v", err)
+	}
+	sw := &Switcher{
+		chains:     chains,
+		feed:       feed,
+		path:       cfg.Path,
+		rewards:    make(map[string]*big.Float),
+		hysteresis: cfg.Hysteresis,
+		quit:       make(chan struct{}),
+	}
+	if len(sw.path) == 0 {
+		sw.path = "/auto"
+	}
+	for _, name := range chains.names {
+		v := chains.servers[name].config.BlockReward
+		if len(v) == 0 {
+			log.Printf("Chain %s has no block reward, it's never chosen by profit switching", name)
+			continue
+		}
+		reward, ok := new(big.Float).SetString(v)
+		if !ok {
+			log.Fatalf("Invalid block reward of %s chain: %v", name, v)
+		}
+		// Rewards are configured in wei
+		sw.rewards[name] = reward.Quo(reward, big.NewFloat(1e18))
+	}
+	minDwell, err := time.ParseDuration(cfg.MinDwell)
+	if err == nil {
+		sw.minDwell = minDwell
+	}
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		interval = time.Minute
+	}
+
+	// Start on the default chain until prices are known, the first switch doesn't wait for dwell time
+	sw.current = chains.names[0]
+	sw.evaluate()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-sw.quit:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				sw.evaluate()
+			}
+		}
+	}()
+	log.Printf("Profit switching at %s/miner/ every %v, hysteresis %v%%, min dwell %v", sw.path, interval, sw.hysteresis, sw.minDwell)
+	return sw
+}
+
+func (sw *Switcher) Path() string {
+	return sw.path
+}
+
+func (sw *Switcher) Stop() {
+	if sw == nil {
+		return
+	}
+	close(sw.quit)
+}
+
+func (sw *Switcher) currentChain() string {
+	sw.RLock()
+	defer sw.RUnlock()
+	return sw.current
+}
+
+// Requests are served by the proxy of currently chosen chain
+func (sw *Switcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw.chains.servers[sw.currentChain()].ServeHTTP(w, r)
+}
+
+// Expected revenue per hash of every eligible chain, price units per hash
+func (sw *Switcher) revenue() (map[string]float64, error) {
+	prices, err := sw.feed.Prices()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]float64)
+	for _, name := range sw.chains.names {
+		s := sw.chains.servers[name]
+		reward, ok := sw.rewards[name]
+		price, hasPrice := prices[name]
+		t := s.currentBlockTemplate()
+		if !ok || !hasPrice || t.Difficulty == nil || t.Difficulty.Sign() <= 0 || s.rpc().Sick() {
+			continue
+		}
+		value, _ := new(big.Float).Mul(reward, big.NewFloat(price)).Float64()
+		diff, _ := new(big.Float).SetInt(t.Difficulty).Float64()
+		result[name] = value / diff
+	}
+	return result, nil
+}
+
+func (sw *Switcher) evaluate() {
+	revenue, err := sw.revenue()
+	if err != nil {
+		log.Printf("Profit switching skipped, unable to get prices: %v", err)
+		return
+	}
+
+	sw.Lock()
+	defer sw.Unlock()
+	decision := &SwitchDecision{Timestamp: util.MakeTimestamp(), From: sw.current, To: sw.current, Revenue: revenue}
+	best := ""
+	var names []string
+	for name := range revenue {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(best) == 0 || revenue[name] > revenue[best] {
+			best = name
+		}
+	}
+	current, eligible := revenue[sw.current]
+	dwell := time.Since(sw.switchedAt)
+
+	switch {
+	case len(best) == 0:
+		decision.Reason = "no chain with known price, reward and difficulty"
+	case best == sw.current:
+		decision.Reason = "current chain is the most profitable"
+	case !eligible:
+		decision.To = best
+		decision.Reason = "current chain is not eligible"
+	case dwell < sw.minDwell:
+		decision.Reason = fmt.Sprintf("%s is better but dwell time %v is below %v", best, dwell, sw.minDwell)
+	case revenue[best] < current*(1+sw.hysteresis/100):
+		decision.Reason = fmt.Sprintf("%s is better by %.2f%%, below hysteresis", best, 100*(revenue[best]/current-1))
+	default:
+		decision.To = best
+		decision.Reason = fmt.Sprintf("%s is better by %.2f%%", best, 100*(revenue[best]/current-1))
+	}
+
+	if decision.To != sw.current {
+		decision.Switched = true
+		sw.current = decision.To
+		sw.switchedAt = time.Now()
+		log.Printf("Profit switching from %s to %s: %s", decision.From, decision.To, decision.Reason)
+	} else {
+		log.Printf("Profit switching stays on %s: %s", sw.current, decision.Reason)
+	}
+	sw.decisions = append(sw.decisions, decision)
+	if len(sw.decisions) > maxSwitchDecisions {
+		sw.decisions = sw.decisions[len(sw.decisions)-maxSwitchDecisions:]
+	}
+}
+
+func (sw *Switcher) SwitchingStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if sw == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Profit switching is disabled"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	sw.RLock()
+	switchedAt := int64(0)
+	if !sw.switchedAt.IsZero() {
+		switchedAt = sw.switchedAt.UnixNano() / int64(time.Millisecond)
+	}
+	stats := map[string]interface{}{
+		"current":    sw.current,
+		"switchedAt": switchedAt,
+		"hysteresis": sw.hysteresis,
+		"minDwell":   sw.minDwell.String(),
+		"url":        "http://" + sw.chains.Default().config.Proxy.Listen + sw.path + "/miner/<diff>/<id>",
+		"decisions":  sw.decisions,
+		"now":        util.MakeTimestamp(),
+	}
+	json.NewEncoder(w).Encode(stats)
+	sw.RUnlock()
+}
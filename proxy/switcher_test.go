@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../rpc"
+)
+
+func newTestChain(t *testing.T, name, reward string, diff int64) *ProxyServer {
+	client, err := rpc.NewRPCClient(name+"-geth", "http://127.0.0.1:1", "1s", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ProxyServer{config: &Config{Chain: name, BlockReward: reward}, upstreams: []*rpc.RPCClient{client}}
+	s.blockTemplate.Store(&BlockTemplate{Difficulty: big.NewInt(diff)})
+	return s
+}
+
+func writePrices(t *testing.T, path string, prices string) {
+	if err := ioutil.WriteFile(path, []byte(prices), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Both chains have the same difficulty, ETC reward is twice as large
+func newTestSwitcher(t *testing.T, feed PriceFeedConfig) *Switcher {
+	chains := &ChainSet{servers: make(map[string]*ProxyServer)}
+	chains.add("eth", newTestChain(t, "eth", "2000000000000000000", 1000))
+	chains.add("etc", newTestChain(t, "etc", "4000000000000000000", 1000))
+	sw := NewSwitcher(&Switching{Enabled: true, Interval: "1h", Hysteresis: 5, MinDwell: "1h", PriceFeed: feed}, chains)
+	t.Cleanup(sw.Stop)
+	return sw
+}
+
+func lastDecision(sw *Switcher) *SwitchDecision {
+	sw.RLock()
+	defer sw.RUnlock()
+	if len(sw.decisions) == 0 {
+		return nil
+	}
+	return sw.decisions[len(sw.decisions)-1]
+}
+
+func TestSwitcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.json")
+	writePrices(t, path, `{"eth": 10, "etc": 4}`)
+	sw := newTestSwitcher(t, PriceFeedConfig{Path: path})
+	if sw.currentChain() != "eth" {
+		t.Fatalf("Expected to stay on eth, got %s", sw.currentChain())
+	}
+	if rewards := sw.rewards["etc"]; rewards == nil || rewards.String() != "4" {
+		t.Fatalf("Expected reward of etc chain from its config, got %v", rewards)
+	}
+
+	// The first switch doesn't wait for dwell time
+	writePrices(t, path, `{"eth": 10, "etc": 6}`)
+	sw.evaluate()
+	if d := lastDecision(sw); sw.currentChain() != "etc" || !d.Switched {
+		t.Fatalf("Expected switch to etc, got %s: %+v", sw.currentChain(), d)
+	}
+
+	// ETH is better by 8%, but dwell time isn't over
+	writePrices(t, path, `{"eth": 13, "etc": 6}`)
+	sw.evaluate()
+	if d := lastDecision(sw); sw.currentChain() != "etc" || d.Switched || !strings.Contains(d.Reason, "dwell") {
+		t.Fatalf("Expected to stay on etc for dwell time, got %s: %+v", sw.currentChain(), d)
+	}
+
+	sw.Lock()
+	sw.switchedAt = time.Now().Add(-2 * time.Hour)
+	sw.Unlock()
+	sw.evaluate()
+	if sw.currentChain() != "eth" {
+		t.Fatalf("Expected switch to eth after dwell time, got %s", sw.currentChain())
+	}
+
+	// ETC is better by 4.6%, below hysteresis
+	sw.Lock()
+	sw.switchedAt = time.Now().Add(-2 * time.Hour)
+	sw.Unlock()
+	writePrices(t, path, `{"eth": 13, "etc": 6.8}`)
+	sw.evaluate()
+	if d := lastDecision(sw); sw.currentChain() != "eth" || !strings.Contains(d.Reason, "hysteresis") {
+		t.Fatalf("Expected to stay on eth within hysteresis, got %s: %+v", sw.currentChain(), d)
+	}
+
+	// Current chain lost its price, dwell time doesn't matter
+	sw.Lock()
+	sw.switchedAt = time.Now()
+	sw.Unlock()
+	writePrices(t, path, `{"etc": 6}`)
+	sw.evaluate()
+	if sw.currentChain() != "etc" {
+		t.Fatalf("Expected switch from ineligible chain, got %s", sw.currentChain())
+	}
+
+	// Feed failure keeps current chain and records no decision
+	decisions := len(sw.decisions)
+	os.Remove(path)
+	sw.evaluate()
+	if sw.currentChain() != "etc" || len(sw.decisions) != decisions {
+		t.Fatalf("Expected no decision on feed failure, got %s and %v decisions", sw.currentChain(), len(sw.decisions))
+	}
+}
+
+func TestSwitcherHttpFeed(t *testing.T) {
+	prices := `{"eth": 10, "etc": 6}`
+	var fail int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, prices)
+	}))
+	defer ts.Close()
+
+	sw := newTestSwitcher(t, PriceFeedConfig{Url: ts.URL, Timeout: "1s"})
+	if sw.currentChain() != "etc" {
+		t.Fatalf("Expected switch to etc, got %s", sw.currentChain())
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	if _, err := sw.feed.Prices(); err == nil {
+		t.Fatal("Expected error on feed failure")
+	}
+	sw.evaluate()
+	if sw.currentChain() != "etc" || len(sw.decisions) != 1 {
+		t.Fatalf("Expected no decision on feed failure, got %s and %v decisions", sw.currentChain(), len(sw.decisions))
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Posts alerts to an HTTP endpoint as generic JSON or in Slack, Discord or Telegram shape
+type Webhook struct {
+	url    string
+	format string
+	chatId string
+	client *http.Client
+}
+
+func NewWebhook(cfg *WebhookConfig) *Webhook {
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		timeout = 10 * time.Second
+	}
+	return &Webhook{url: cfg.Url, format: cfg.Format, chatId: cfg.ChatId, client: &http.Client{Timeout: timeout}}
+}
+
+func (w *Webhook) payload(a *Alert) interface{} {
+	switch w.format {
+	case "slack":
+		return map[string]interface{}{"text": a.Text()}
+	case "discord":
+		return map[string]interface{}{"content": a.Text()}
+	case "telegram":
+		return map[string]interface{}{"chat_id": w.chatId, "text": a.Text()}
+	default:
+		return a
+	}
+}
+
+func (w *Webhook) Notify(a *Alert) error {
+	data, err := json.Marshal(w.payload(a))
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s replied with %s", w.url, resp.Status)
+	}
+	return nil
+}
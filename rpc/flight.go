@@ -0,0 +1,39 @@
+package rpc
+
+import "sync"
+
+type flightCall struct {
+	done  chan struct{}
+	reply interface{}
+	err   error
+}
+
+// Concurrent requests with the same key share a single upstream call
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Returns reply of fn, shared is true if it was started by another caller
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (reply interface{}, err error, shared bool) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.Unlock()
+		<-c.done
+		return c.reply, c.err, true
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.Unlock()
+
+	c.reply, c.err = fn()
+
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	close(c.done)
+	return c.reply, c.err, false
+}
@@ -7,9 +7,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"../util"
 )
 
 type RPCClient struct {
@@ -25,6 +28,23 @@ type RPCClient struct {
 	LastSubmissionAt int64
 	client           *http.Client
 	FailsCount       uint64
+	ValidShares      uint64
+	InvalidShares    uint64
+	StaleShares      uint64
+	MalformedShares  uint64
+	DuplicateShares  uint64
+	HashrateId       string
+	Hashrate         uint64
+	HashrateAt       int64
+	Etherbase        string
+	coinbase         string
+	coinbaseMismatch bool
+	flight           flightGroup
+	work             []string
+	workAt           time.Time
+	calls            map[string]uint64
+	coalescedCalls   uint64
+	cachedCalls      uint64
 }
 
 type GetBlockReply struct {
@@ -38,12 +58,17 @@ type JSONRpcResp struct {
 	Error  map[string]interface{} `json:"error"`
 }
 
-func NewRPCClient(name, rawUrl, timeout string, pool bool) (*RPCClient, error) {
+func NewRPCClient(name, rawUrl, timeout, etherbase string, pool bool) (*RPCClient, error) {
 	url, err := url.Parse(rawUrl)
 	if err != nil {
 		return nil, err
 	}
-	rpcClient := &RPCClient{Name: name, Url: url, Pool: pool}
+	// Pools pay to their own address, there is no coinbase to verify
+	if pool && len(etherbase) > 0 {
+		return nil, errors.New("upstream " + name + " is a pool, etherbase is allowed for solo upstreams only")
+	}
+	rpcClient := &RPCClient{Name: name, Url: url, Pool: pool, Etherbase: etherbase, calls: make(map[string]uint64)}
+	rpcClient.HashrateId = util.MakeHashrateId("ether-proxy/" + name + "/" + url.String())
 	timeoutIntv, _ := time.ParseDuration(timeout)
 	rpcClient.client = &http.Client{
 		Timeout: timeoutIntv,
@@ -51,7 +76,39 @@ func NewRPCClient(name, rawUrl, timeout string, pool bool) (*RPCClient, error) {
 	return rpcClient, nil
 }
 
+// Concurrent callers, e.g. template refresh and upstream check, share one request
 func (r *RPCClient) GetWork() ([]string, error) {
+	reply, err, shared := r.flight.do("eth_getWork", r.getWork)
+	if shared {
+		atomic.AddUint64(&r.coalescedCalls, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply.([]string), nil
+}
+
+// Returns last getWork reply if it's not older than maxAge, requests a new one otherwise.
+// Zero maxAge always requests new work without joining a request in flight, which may be older than a found block.
+func (r *RPCClient) GetRecentWork(maxAge time.Duration) ([]string, error) {
+	if maxAge <= 0 {
+		reply, err := r.getWork()
+		if err != nil {
+			return nil, err
+		}
+		return reply.([]string), nil
+	}
+	r.RLock()
+	work, workAt := r.work, r.workAt
+	r.RUnlock()
+	if work != nil && time.Since(workAt) < maxAge {
+		atomic.AddUint64(&r.cachedCalls, 1)
+		return work, nil
+	}
+	return r.GetWork()
+}
+
+func (r *RPCClient) getWork() (interface{}, error) {
 	params := []string{}
 
 	rpcResp, err := r.doPost(r.Url.String(), "eth_getWork", params)
@@ -63,10 +120,28 @@ func (r *RPCClient) GetWork() ([]string, error) {
 		return reply, errors.New(rpcResp.Error["message"].(string))
 	}
 	err = json.Unmarshal(*rpcResp.Result, &reply)
-	return reply, err
+	if err != nil {
+		return reply, err
+	}
+	if len(reply) < 3 {
+		return reply, errors.New("malformed getWork reply")
+	}
+	r.Lock()
+	r.work = reply
+	r.workAt = time.Now()
+	r.Unlock()
+	return reply, nil
 }
 
 func (r *RPCClient) GetPendingBlock() (GetBlockReply, error) {
+	reply, err, shared := r.flight.do("eth_getBlockByNumber", r.getPendingBlock)
+	if shared {
+		atomic.AddUint64(&r.coalescedCalls, 1)
+	}
+	return reply.(GetBlockReply), err
+}
+
+func (r *RPCClient) getPendingBlock() (interface{}, error) {
 	params := []interface{}{"pending", false}
 
 	rpcResp, err := r.doPost(r.Url.String(), "eth_getBlockByNumber", params)
@@ -81,6 +156,56 @@ func (r *RPCClient) GetPendingBlock() (GetBlockReply, error) {
 	return reply, err
 }
 
+func (r *RPCClient) GetCoinbase() (string, error) {
+	rpcResp, err := r.doPost(r.Url.String(), "eth_coinbase", []string{})
+	var reply string
+	if err != nil {
+		return reply, err
+	}
+	if rpcResp.Error != nil {
+		return reply, errors.New(rpcResp.Error["message"].(string))
+	}
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Compares node coinbase with expected etherbase, nodes without expected one always pass
+func (r *RPCClient) VerifyCoinbase() error {
+	if len(r.Etherbase) == 0 {
+		return nil
+	}
+	coinbase, err := r.GetCoinbase()
+	if err != nil {
+		// Node which can't tell its coinbase is not trusted with work
+		r.Lock()
+		r.coinbase = ""
+		r.coinbaseMismatch = true
+		r.Unlock()
+		return err
+	}
+	mismatch := !strings.EqualFold(coinbase, r.Etherbase)
+	r.Lock()
+	r.coinbase = coinbase
+	r.coinbaseMismatch = mismatch
+	r.Unlock()
+	if mismatch {
+		return errors.New("coinbase " + coinbase + " doesn't match etherbase " + r.Etherbase)
+	}
+	return nil
+}
+
+func (r *RPCClient) Coinbase() string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.coinbase
+}
+
+func (r *RPCClient) CoinbaseMismatch() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.coinbaseMismatch
+}
+
 func (r *RPCClient) SubmitBlock(params []string) (bool, error) {
 	rpcResp, err := r.doPost(r.Url.String(), "eth_submitWork", params)
 	var result bool
@@ -114,6 +239,9 @@ func (r *RPCClient) SubmitHashrate(params interface{}) (bool, error) {
 }
 
 func (r *RPCClient) doPost(url, method string, params interface{}) (JSONRpcResp, error) {
+	r.Lock()
+	r.calls[method]++
+	r.Unlock()
 	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "id": 0, "method": method, "params": params}
 	data, _ := json.Marshal(jsonReq)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
@@ -144,6 +272,10 @@ func (r *RPCClient) Check() (bool, error) {
 		return false, err
 	}
 	r.markAlive()
+	// Node mining to a wrong address is alive but must not get work
+	if err := r.VerifyCoinbase(); err != nil {
+		return false, err
+	}
 	return !r.Sick(), nil
 }
 
@@ -176,3 +308,19 @@ func (r *RPCClient) markAlive() {
 	}
 	r.Unlock()
 }
+
+// Number of requests made per method
+func (r *RPCClient) Calls() map[string]uint64 {
+	r.RLock()
+	defer r.RUnlock()
+	calls := make(map[string]uint64, len(r.calls))
+	for k, v := range r.calls {
+		calls[k] = v
+	}
+	return calls
+}
+
+// Number of calls served by another in-flight request or by cached getWork reply
+func (r *RPCClient) SavedCalls() (coalesced, cached uint64) {
+	return atomic.LoadUint64(&r.coalescedCalls), atomic.LoadUint64(&r.cachedCalls)
+}
@@ -0,0 +1,170 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Node answering getWork with a new header each time, requests wait until released
+type testNode struct {
+	*httptest.Server
+	sync.Mutex
+	getWorks int32
+	release  chan struct{}
+	coinbase string
+}
+
+func newTestNode(t *testing.T) *testNode {
+	n := &testNode{release: make(chan struct{}), coinbase: "0x0000000000000000000000000000000000000001"}
+	close(n.release)
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id     *json.RawMessage `json:"id"`
+			Method string           `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		reply := map[string]interface{}{"id": req.Id, "jsonrpc": "2.0"}
+		n.Lock()
+		release, coinbase := n.release, n.coinbase
+		n.Unlock()
+		switch req.Method {
+		case "eth_getWork":
+			i := atomic.AddInt32(&n.getWorks, 1)
+			<-release
+			header := "0x" + string('0'+byte(i))
+			reply["result"] = []string{header, "0x02", "0x03"}
+		case "eth_coinbase":
+			if len(coinbase) == 0 {
+				reply["error"] = map[string]interface{}{"code": -32000, "message": "no coinbase"}
+			} else {
+				reply["result"] = coinbase
+			}
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *testNode) set(release chan struct{}, coinbase string) {
+	n.Lock()
+	n.release, n.coinbase = release, coinbase
+	n.Unlock()
+}
+
+func newTestClient(t *testing.T, n *testNode, etherbase string) *RPCClient {
+	r, err := NewRPCClient("main", n.URL, "5s", etherbase, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// Waits until n getWork requests reached the node
+func waitGetWorks(t *testing.T, node *testNode, n int32) {
+	for i := 0; atomic.LoadInt32(&node.getWorks) < n; i++ {
+		if i > 500 {
+			t.Fatalf("Expected %v getWork requests, got %v", n, atomic.LoadInt32(&node.getWorks))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGetWorkCoalescing(t *testing.T) {
+	n := newTestNode(t)
+	release := make(chan struct{})
+	n.set(release, n.coinbase)
+	r := newTestClient(t, n, "")
+
+	var wg sync.WaitGroup
+	replies := make([][]string, 5)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i], _ = r.GetWork()
+		}(i)
+	}
+	waitGetWorks(t, n, 1)
+	// Let other callers join the request in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&n.getWorks); calls != 1 {
+		t.Errorf("Expected one upstream request, got %v", calls)
+	}
+	for i, v := range replies {
+		if len(v) == 0 || v[0] != "0x1" {
+			t.Errorf("Caller %v got %v", i, v)
+		}
+	}
+	if coalesced, _ := r.SavedCalls(); coalesced != 4 {
+		t.Errorf("Expected 4 coalesced calls, got %v", coalesced)
+	}
+}
+
+func TestGetRecentWork(t *testing.T) {
+	n := newTestNode(t)
+	r := newTestClient(t, n, "")
+
+	first, err := r.GetRecentWork(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work, _ := r.GetRecentWork(time.Minute); work[0] != first[0] || atomic.LoadInt32(&n.getWorks) != 1 {
+		t.Errorf("Expected cached work, got %v after %v requests", work, n.getWorks)
+	}
+	if _, cached := r.SavedCalls(); cached != 1 {
+		t.Errorf("Expected one cached call, got %v", cached)
+	}
+	if work, _ := r.GetRecentWork(0); work[0] == first[0] {
+		t.Errorf("Zero age must bypass cache, got %v", work)
+	}
+
+	// Zero age doesn't join request in flight, its reply may be older than a found block
+	release := make(chan struct{})
+	n.set(release, n.coinbase)
+	done := make(chan struct{})
+	go func() {
+		r.GetWork()
+		close(done)
+	}()
+	waitGetWorks(t, n, 3)
+	go r.GetRecentWork(0)
+	waitGetWorks(t, n, 4)
+	close(release)
+	<-done
+}
+
+func TestVerifyCoinbase(t *testing.T) {
+	n := newTestNode(t)
+	if err := newTestClient(t, n, "").VerifyCoinbase(); err != nil {
+		t.Errorf("Upstream without etherbase must pass, got %v", err)
+	}
+
+	r := newTestClient(t, n, "0x0000000000000000000000000000000000000001")
+	if err := r.VerifyCoinbase(); err != nil || r.CoinbaseMismatch() {
+		t.Errorf("Expected coinbase to match, got %v", err)
+	}
+	n.set(n.release, "0x0000000000000000000000000000000000000002")
+	if err := r.VerifyCoinbase(); err == nil || !r.CoinbaseMismatch() || r.Coinbase() != "0x0000000000000000000000000000000000000002" {
+		t.Errorf("Expected mismatch, got %v", err)
+	}
+	if ok, _ := r.Check(); ok {
+		t.Error("Upstream mining to another address must fail check")
+	}
+	n.set(n.release, "")
+	if err := r.VerifyCoinbase(); err == nil || !r.CoinbaseMismatch() || r.Coinbase() != "" {
+		t.Errorf("Expected mismatch when coinbase is unknown, got %v", err)
+	}
+
+	if _, err := NewRPCClient("pool", n.URL, "5s", "0x0000000000000000000000000000000000000001", true); err == nil {
+		t.Error("Pool upstream can't have etherbase")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package upgrade
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals triggering upgrade
+var Signals = []os.Signal{syscall.SIGUSR2}
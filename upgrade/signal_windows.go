@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package upgrade
+
+import "os"
+
+// Upgrade is not supported on windows
+var Signals = []os.Signal{}
@@ -0,0 +1,143 @@
+// Zero-downtime binary upgrade: listening sockets and a state snapshot are
+// handed to a freshly exec'd copy of the process.
+package upgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const envKey = "ETHER_PROXY_UPGRADE"
+
+// Inherited descriptors start right after stdin, stdout and stderr
+const firstFd = 3
+
+// Returns true if this process was started by an upgrading parent
+func IsChild() bool {
+	return os.Getenv(envKey) == "1"
+}
+
+// Returns inherited listener at given index when upgrading or a new one bound to addr
+func Listen(index int, addr string) (net.Listener, error) {
+	if IsChild() {
+		f := os.NewFile(uintptr(firstFd+index), "listener")
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Tells parent that this process serves inherited listeners, so parent may start draining
+func Ready(count int) error {
+	f := os.NewFile(uintptr(firstFd+count+1), "ready")
+	defer f.Close()
+	_, err := f.Write([]byte{1})
+	return err
+}
+
+// Blocks until parent has drained and written its state, must follow Ready call
+func ReadState(count int, v interface{}) error {
+	f := os.NewFile(uintptr(firstFd+count), "state")
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+type Child struct {
+	cmd   *exec.Cmd
+	state *os.File
+	ready *os.File
+}
+
+// Starts a new copy of the binary with the same arguments and given listeners
+func Spawn(listeners ...net.Listener) (*Child, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return nil, errors.New("upgrade: only TCP listeners can be handed off")
+		}
+		f, err := tl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, r)
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	// Our copy of write end is closed after start, so read fails if child exits
+	files = append(files, readyW)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envKey+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		readyR.Close()
+		return nil, err
+	}
+	return &Child{cmd: cmd, state: w, ready: readyR}, nil
+}
+
+func (c *Child) Pid() int {
+	return c.cmd.Process.Pid
+}
+
+// Waits until child serves inherited listeners
+func (c *Child) WaitReady(timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := c.ready.Read(buf)
+		if err == io.EOF {
+			err = errors.New("upgrade: process exited before it was ready")
+		}
+		result <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errors.New("upgrade: process not ready in " + timeout.String())
+	}
+}
+
+// Stops child which failed to start, listeners stay with this process
+func (c *Child) Kill() {
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	c.state.Close()
+	c.ready.Close()
+}
+
+// Passes state to ready child, which merges it into its own
+func (c *Child) WriteState(v interface{}) error {
+	defer c.state.Close()
+	defer c.ready.Close()
+	return json.NewEncoder(c.state).Encode(v)
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"crypto/sha256"
 	"math/big"
 	"math/rand"
 	"strconv"
@@ -34,3 +35,9 @@ func TargetHexToDiff(targetHex string) *big.Int {
 	targetBytes := common.FromHex(targetHex)
 	return new(big.Int).Div(pow256, new(big.Int).SetBytes(targetBytes))
 }
+
+// Stable 32 byte id for eth_submitHashrate derived from seed
+func MakeHashrateId(seed string) string {
+	id := sha256.Sum256([]byte(seed))
+	return common.ToHex(id[:])
+}
@@ -0,0 +1,74 @@
+var colors = ["#1994b8", "#5cb85c", "#f0ad4e", "#d9534f", "#777777", "#5bc0de"];
+
+$(function() {
+	window.charts = {};
+	window.resolution = "minute";
+	$("#home-link").attr("href", "/" + window.location.search);
+	refreshHistory();
+
+	$("[data-resolution]").click(function() {
+		$("[data-resolution]").removeClass("active");
+		$(this).addClass("active");
+		window.resolution = $(this).data("resolution");
+		refreshHistory();
+	});
+
+	setInterval(refreshHistory, 60000)
+});
+
+function refreshHistory() {
+	// Chain is passed through from page URL, e.g. ?chain=etc
+	var chain = window.location.search.match(/[?&]chain=([^&]*)/);
+	var query = "?resolution=" + window.resolution + (chain ? "&chain=" + chain[1] : "");
+	$.getJSON("/stats/history" + query, function(history) {
+		$("#alert").addClass('hide');
+		var points = history.points || [];
+
+		var labels = points.map(function(p) {
+			var d = new Date(p.timestamp);
+			if (history.resolution == "minute") {
+				return ("0" + d.getHours()).slice(-2) + ":" + ("0" + d.getMinutes()).slice(-2);
+			}
+			return d.toLocaleString();
+		});
+
+		// Total hashrate and one line per upstream ever seen in this window
+		var upstreams = {};
+		points.forEach(function(p) {
+			Object.keys(p.upstreams).forEach(function(name) { upstreams[name] = true; });
+		});
+		var hashrate = [{ label: "Total", data: points.map(function(p) { return p.hashrate; }) }];
+		Object.keys(upstreams).sort().forEach(function(name) {
+			hashrate.push({
+				label: name,
+				data: points.map(function(p) { return p.upstreams[name] ? p.upstreams[name].hashrate : 0; })
+			});
+		});
+		drawChart("hashrate-chart", labels, hashrate);
+
+		var shares = ["valid", "invalid", "stale", "duplicate", "malformed"].map(function(kind) {
+			return { label: kind, data: points.map(function(p) { return p.shares[kind] || 0; }) };
+		});
+		drawChart("shares-chart", labels, shares);
+	}).fail(function() {
+		$("#alert").removeClass('hide');
+	});
+}
+
+function drawChart(canvasId, labels, datasets) {
+	datasets.forEach(function(d, i) {
+		d.borderColor = colors[i % colors.length];
+		d.backgroundColor = colors[i % colors.length];
+		d.fill = false;
+		d.pointRadius = 0;
+		d.borderWidth = 1;
+	});
+	if (window.charts[canvasId]) {
+		window.charts[canvasId].destroy();
+	}
+	window.charts[canvasId] = new Chart(document.getElementById(canvasId), {
+		type: "line",
+		data: { labels: labels, datasets: datasets },
+		options: { animation: false, scales: { xAxes: [{ ticks: { maxTicksLimit: 12 } }] } }
+	});
+}
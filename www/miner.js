@@ -0,0 +1,67 @@
+HandlebarsIntl.registerWith(Handlebars);
+
+$(function() {
+	window.charts = {};
+	var id = decodeURIComponent(window.location.hash.substr(1));
+	var source = $("#miner-template").html();
+	var template = Handlebars.compile(source);
+	$("#miner-id").text(id);
+	$("#home-link").attr("href", "/" + window.location.search);
+	refreshMiner(template, id);
+
+	setInterval(function() {
+		refreshMiner(template, id);
+	}, 30000)
+});
+
+function refreshMiner(template, id) {
+	// Chain is passed through from page URL, e.g. ?chain=etc
+	$.getJSON("/stats/miner/" + encodeURIComponent(id) + window.location.search, function(stats) {
+		$("#alert").addClass('hide');
+
+		var html = template(stats);
+		$('#stats').html(html);
+
+		var labels = stats.history.map(function(item) {
+			var d = new Date(item.timestamp);
+			return ("0" + d.getHours()).slice(-2) + ":" + ("0" + d.getMinutes()).slice(-2);
+		});
+		drawChart("hashrate-chart", labels, stats.history, [
+			{ key: "hashrate", label: "Hashrate", color: "#1994b8" }
+		]);
+		drawChart("shares-chart", labels, stats.history, [
+			{ key: "valid", label: "Valid", color: "#5cb85c" },
+			{ key: "invalid", label: "Invalid", color: "#d9534f" },
+			{ key: "stale", label: "Stale", color: "#f0ad4e" },
+			{ key: "duplicate", label: "Duplicate", color: "#777777" }
+		]);
+		drawChart("submissions-chart", labels, stats.history, [
+			{ key: "accepts", label: "Accepted", color: "#5cb85c" },
+			{ key: "rejects", label: "Rejected", color: "#d9534f" }
+		]);
+	}).fail(function() {
+		$("#alert").removeClass('hide');
+	});
+}
+
+function drawChart(canvasId, labels, history, series) {
+	var datasets = series.map(function(s) {
+		return {
+			label: s.label,
+			data: history.map(function(item) { return item[s.key]; }),
+			borderColor: s.color,
+			backgroundColor: s.color,
+			fill: false,
+			pointRadius: 0,
+			borderWidth: 1
+		};
+	});
+	if (window.charts[canvasId]) {
+		window.charts[canvasId].destroy();
+	}
+	window.charts[canvasId] = new Chart(document.getElementById(canvasId), {
+		type: "line",
+		data: { labels: labels, datasets: datasets },
+		options: { animation: false, scales: { xAxes: [{ ticks: { maxTicksLimit: 12 } }] } }
+	});
+}
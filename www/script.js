@@ -1,4 +1,5 @@
 HandlebarsIntl.registerWith(Handlebars);
+Handlebars.registerHelper('encode', encodeURIComponent);
 
 $(function() {
 	window.state = {};
@@ -12,8 +13,21 @@ $(function() {
 });
 
 function refreshStats(template) {
-	$.getJSON("/stats", function(stats) {
+	// Group filter and chain are passed through from page URL, e.g. ?chain=etc&group=site:eu1
+	$.when($.getJSON("/stats" + window.location.search), $.getJSON("/stats/chains")).done(function(statsReply, chainsReply) {
+		var stats = statsReply[0];
 		$("#alert").addClass('hide');
+		stats.filtered = stats.filter && Object.keys(stats.filter).length > 0;
+
+		// Links keep selected chain once there are several of them
+		stats.chains = chainsReply[0].chains || [];
+		stats.multiChain = stats.chains.length > 1;
+		stats.chainParam = stats.multiChain ? "chain=" + encodeURIComponent(stats.chain) + "&" : "";
+		stats.chainQuery = stats.multiChain ? "?chain=" + encodeURIComponent(stats.chain) : "";
+		stats.chains.forEach(function(chain) {
+			chain.current = chain.name == stats.chain;
+		});
+		$("#history-link").attr("href", "history.html" + stats.chainQuery);
 
 		// Sort miners by ID
 		if (stats.miners) {